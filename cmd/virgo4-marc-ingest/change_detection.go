@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// the number of delivered record state changes we accumulate before writing them to the state store
+var changeFlushSize = 1000
+
+//
+// decides if a record has changed since it was last published by comparing a hash of its content with the one
+// in the state store. The hash is of the record as loaded, before any transforms, so transforms that add
+// something different every time (like a timestamp) do not make every record look changed. The new hash is
+// only written once the record has been delivered, so a record we fail to deliver is published again.
+//
+type changeDetector struct {
+	store     *stateStore              // where the hashes are kept
+	lock      sync.Mutex               // the changes are confirmed by the workers
+	pending   map[string]*recordChange // changes sent but not yet delivered, the latest for each record
+	confirmed map[string]*recordState  // delivered changes not yet written to the store, nil means remove
+	unchanged map[string]int           // the number of unchanged records in each file
+	err       error                    // the first error writing the delivered changes
+}
+
+// a change to the state of a record, written to the store once the record has been delivered
+type recordChange struct {
+	detector *changeDetector // where the change is kept (nil when we are not detecting changes)
+	id       string          // the record id
+	state    *recordState    // the new state, nil means remove
+}
+
+func newChangeDetector(store *stateStore) *changeDetector {
+
+	if store == nil {
+		return nil
+	}
+
+	return &changeDetector{
+		store:     store,
+		pending:   make(map[string]*recordChange),
+		confirmed: make(map[string]*recordState),
+		unchanged: make(map[string]int),
+	}
+}
+
+// has the record changed since it was last published, returns the change to confirm once the record has been
+// delivered or nil if it has not changed. Deleted records have always changed
+func (c *changeDetector) changed(file string, rec Record) (*recordChange, error) {
+
+	if c == nil {
+		return &recordChange{}, nil
+	}
+
+	id, err := rec.Id()
+	if err != nil {
+		return nil, err
+	}
+
+	// we forget about deleted records so they are published if they come back
+	if rec.Deleted() == true {
+		return c.queue(id, nil), nil
+	}
+
+	hash := recordHash(rec)
+
+	previous, found := c.latest(id)
+	if found == false {
+		state, ok, err := c.store.recordState(id)
+		if err != nil {
+			return nil, err
+		}
+		if ok == true {
+			previous = &state
+		}
+	}
+
+	if previous != nil && previous.Hash == hash {
+		c.unchanged[file]++
+		return nil, nil
+	}
+
+	return c.queue(id, &recordState{Hash: hash, File: file, Updated: time.Now()}), nil
+}
+
+// the latest state of a record not yet written to the store, if any
+func (c *changeDetector) latest(id string) (*recordState, bool) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if change, found := c.pending[id]; found == true {
+		return change.state, true
+	}
+	state, found := c.confirmed[id]
+	return state, found
+}
+
+func (c *changeDetector) queue(id string, state *recordState) *recordChange {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	change := &recordChange{detector: c, id: id, state: state}
+	c.pending[id] = change
+	return change
+}
+
+// the record has been delivered, the change is written to the store with the next flush
+func (r *recordChange) confirm() {
+
+	if r == nil || r.detector == nil {
+		return
+	}
+
+	c := r.detector
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// an earlier change to the same record is superseded by the later one
+	if c.pending[r.id] != r {
+		return
+	}
+	delete(c.pending, r.id)
+	c.confirmed[r.id] = r.state
+
+	if len(c.confirmed) >= changeFlushSize && c.err == nil {
+		c.err = c.writeConfirmed()
+	}
+}
+
+// write the delivered changes to the store, called once every record has been delivered
+func (c *changeDetector) flush() error {
+
+	if c == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	return c.writeConfirmed()
+}
+
+// the lock must be held
+func (c *changeDetector) writeConfirmed() error {
+
+	if len(c.confirmed) == 0 {
+		return nil
+	}
+
+	err := c.store.updateRecordStates(c.confirmed)
+	if err != nil {
+		return err
+	}
+	c.confirmed = make(map[string]*recordState)
+	return nil
+}
+
+// the number of unchanged records found in the specified file
+func (c *changeDetector) unchangedCount(file string) int {
+	if c == nil {
+		return 0
+	}
+	return c.unchanged[file]
+}
+
+// the content hash of a record, the data source is included because the same record from a different source
+// is a different document
+func recordHash(rec Record) string {
+
+	h := sha256.New()
+	h.Write([]byte(rec.Source()))
+	h.Write([]byte{0})
+	h.Write(rec.Raw())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//
+// end of file
+//
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// how far we got with a file, kept in the state store so we can resume if we are restarted part way through
+type checkpointState struct {
+	File    string    `json:"file"`    // the file being ingested
+	ETag    string    `json:"etag"`    // the ETag of the object the file came from
+	Records int       `json:"records"` // the records before this index have all been delivered
+	Offset  int64     `json:"offset"`  // the byte offset of the last record delivered
+	Updated time.Time `json:"updated"` // when the checkpoint was saved
+}
+
+//
+// checkpoints a file as its records are delivered. The workers deliver records in any order so the checkpoint
+// only covers the records before the first one that has not been delivered. When the same object is redelivered
+// after a restart, the file is read from the beginning as usual (so duplicate detection and full dumps see every
+// record) but the records covered by the checkpoint are not published again. The checkpoint is removed once
+// the notification has been dealt with.
+//
+type checkpointer struct {
+	store    *stateStore // where the checkpoint is kept
+	interval int         // the number of records between saves
+	resume   int         // the records before this index were delivered before we restarted
+
+	lock      sync.Mutex
+	state     checkpointState // the current checkpoint
+	saved     int             // the record index as of the last save
+	pending   []int           // the indexes of the records sent but not yet covered by the checkpoint, in order
+	confirmed map[int]int64   // the offsets of the pending records that have been delivered
+}
+
+// the checkpoint for a file, nil if we are not checkpointing it
+func (b *ingestBatch) checkpoint(file NameTuple) (*checkpointer, error) {
+
+	// we need the ETag to be sure a redelivered object is the same one
+	if b.store == nil || b.checkpointInterval == 0 || file.ETag == "" {
+		return nil, nil
+	}
+
+	c := &checkpointer{
+		store:     b.store,
+		interval:  b.checkpointInterval,
+		state:     checkpointState{File: file.RemoteName, ETag: file.ETag},
+		confirmed: make(map[int]int64),
+	}
+
+	previous, found, err := b.store.checkpointState(file.RemoteName)
+	if err != nil {
+		return nil, err
+	}
+	if found == true {
+		if previous.ETag == file.ETag {
+			log.Printf("INFO: resuming %s after record %d (offset %d), checkpointed %s", file.RemoteName, previous.Records, previous.Offset,
+				previous.Updated.Format(time.RFC3339))
+			c.resume = previous.Records
+			c.saved = previous.Records
+			c.state = previous
+		} else {
+			log.Printf("INFO: ignoring checkpoint for %s, the object has changed (ETag %s, was %s)", file.RemoteName, file.ETag, previous.ETag)
+		}
+	}
+
+	b.checkpoints = append(b.checkpoints, c)
+	return c, nil
+}
+
+// remove the checkpoints, called once every record has been delivered
+func (b *ingestBatch) clearCheckpoints() error {
+
+	for _, c := range b.checkpoints {
+		err := c.store.removeCheckpointState(c.state.File)
+		if err != nil {
+			return err
+		}
+	}
+	b.checkpoints = nil
+	return nil
+}
+
+// was the record delivered before we restarted
+func (c *checkpointer) covers(index int) bool {
+	return c != nil && index < c.resume
+}
+
+// a record has been sent to the workers, records are sent in index order
+func (c *checkpointer) sent(index int) {
+
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = append(c.pending, index)
+}
+
+// a record has been delivered, the checkpoint is advanced over any records that have now all been delivered
+func (c *checkpointer) confirm(index int, offset int64) {
+
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.confirmed[index] = offset
+	for len(c.pending) != 0 {
+		next := c.pending[0]
+		offset, found := c.confirmed[next]
+		if found == false {
+			break
+		}
+		delete(c.confirmed, next)
+		c.pending = c.pending[1:]
+		c.state.Records = next + 1
+		c.state.Offset = offset
+	}
+
+	if c.state.Records-c.saved < c.interval {
+		return
+	}
+
+	// a checkpoint we cannot save just means we may publish more records again if we restart
+	c.state.Updated = time.Now()
+	err := c.store.setCheckpointState(c.state)
+	if err != nil {
+		log.Printf("WARNING: unable to save checkpoint for %s (%s)", c.state.File, err.Error())
+		return
+	}
+	c.saved = c.state.Records
+}
+
+// the byte offset of the record within the file
+func recordOffset(rec Record) int64 {
+
+	impl, ok := rec.(*recordImpl)
+	if ok == false {
+		return 0
+	}
+	return impl.offset
+}
+
+//
+// end of file
+//
@@ -3,7 +3,10 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 )
 
 // ServiceConfig defines all of the service configuration parameters
@@ -13,12 +16,47 @@ type ServiceConfig struct {
 	CacheQueueName string // SQS queue name for cache documents (typically records go to the cache)
 	PollTimeOut    int64  // the SQS queue timeout (in seconds)
 
+	VisibilityTimeout int // the inbound message is kept invisible for this long (in seconds) and extended while we are busy (0 to disable)
+
+	EventNames []string // S3 event name patterns that we ingest, events for removed objects (for example) are ignored
+
 	DataSource        string // the name to associate the data with. Each record has metadata showing this value
 	MessageBucketName string // the bucket to use for large messages
 	DownloadDir       string // the S3 file download directory (local)
+	StreamIngest      bool   // stream objects directly from S3 rather than downloading them first
+	XmlOutput         bool   // publish records loaded from MARCXML files as xml rather than base64/marc
+	Marc8Transcode    bool   // convert MARC-8 records to UTF-8
+	Marc8CodeTables   string // the Library of Congress MARC-8 code table file, required for the non-latin character sets
+	RecoverBadRecords bool   // skip corrupt records and carry on with the next one rather than failing the file
+	StrictValidation  bool   // files must also pass strict MARC21 structural validation
+
+	MergeControlPolicy string // when merging continuation records, which duplicate control fields to keep; first or last
+	OversizePolicy     string // what to do when a merged record is too large; reject, first or truncate
+	DuplicatePolicy    string // what to do with records that share an id within a file or batch; ignore, first, last, merge or reject
+
+	DeleteListPatterns []string // file name patterns that identify delete lists (files of record ids, one per line)
+
+	ChangeDetection    bool   // only publish records that have changed since they were last published
+	StateStore         string // the local state store file, required for change detection and full dumps
+	CheckpointInterval int    // the number of records between checkpoints, used to resume a file after a restart (0 to disable)
+
+	FullDumpPatterns   []string // file name patterns that identify full dumps, records missing from them are deleted
+	FullDumpRecordDrop int      // a full dump with this percentage fewer records than the previous one is held (0 to disable)
+	FullDumpSizeDrop   int      // a full dump this percentage smaller than the previous one is held (0 to disable)
+	HoldDir            string   // where held full dumps are described and approved or rejected
+
+	SourceConfigFile string           // the data source specific configuration file (optional)
+	SourceConfigs    *SourceConfigSet // the data source specific configuration
+
+	ErrorPolicy        string // what to do with invalid files; reject-batch, reject-file or quarantine
+	RejectBucket       string // the bucket to write reject reports to (optional)
+	RejectPrefix       string // the key prefix for reject reports
+	BadRecordThreshold int    // when quarantining, the number of bad records above which the whole file is rejected
 
 	WorkerQueueSize int // the inbound message queue size to feed the workers
 	Workers         int // the number of worker processes
+	ParseWorkers    int // the number of goroutines parsing the records of a validated file (1 to parse sequentially)
+	Pipelines       int // the number of inbound notifications processed at once
 }
 
 func envWithDefault(env string, defaultValue string) string {
@@ -54,6 +92,34 @@ func ensureSetAndNonEmpty(env string) string {
 	return val
 }
 
+func envToBoolWithDefault(env string, defaultValue bool) bool {
+
+	value := envWithDefault(env, strconv.FormatBool(defaultValue))
+	b, err := strconv.ParseBool(value)
+	fatalIfError(err)
+	return b
+}
+
+func envToIntWithDefault(env string, defaultValue int) int {
+
+	number := envWithDefault(env, strconv.Itoa(defaultValue))
+	n, err := strconv.Atoi(number)
+	fatalIfError(err)
+	return n
+}
+
+func envToListWithDefault(env string, defaultValue string) []string {
+
+	list := make([]string, 0)
+	for _, item := range strings.Split(envWithDefault(env, defaultValue), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func envToInt(env string) int {
 
 	number := ensureSetAndNonEmpty(env)
@@ -72,26 +138,185 @@ func LoadConfiguration() *ServiceConfig {
 	cfg.OutQueueName = ensureSetAndNonEmpty("VIRGO4_MARC_INGEST_OUT_QUEUE")
 	cfg.CacheQueueName = envWithDefault("VIRGO4_MARC_INGEST_CACHE_QUEUE", "")
 	cfg.PollTimeOut = int64(envToInt("VIRGO4_MARC_INGEST_QUEUE_POLL_TIMEOUT"))
+	cfg.VisibilityTimeout = envToIntWithDefault("VIRGO4_MARC_INGEST_VISIBILITY_TIMEOUT", 300)
+	cfg.EventNames = envToListWithDefault("VIRGO4_MARC_INGEST_EVENT_NAMES", defaultEventNames)
 	cfg.DataSource = envWithDefault("VIRGO4_MARC_INGEST_DATA_SOURCE", "unknown")
 	cfg.MessageBucketName = ensureSetAndNonEmpty("VIRGO4_SQS_MESSAGE_BUCKET")
-	cfg.DownloadDir = ensureSetAndNonEmpty("VIRGO4_MARC_INGEST_DOWNLOAD_DIR")
+	cfg.StreamIngest = envToBoolWithDefault("VIRGO4_MARC_INGEST_STREAM", false)
+	if cfg.StreamIngest == true {
+		cfg.DownloadDir = envWithDefault("VIRGO4_MARC_INGEST_DOWNLOAD_DIR", "")
+	} else {
+		cfg.DownloadDir = ensureSetAndNonEmpty("VIRGO4_MARC_INGEST_DOWNLOAD_DIR")
+	}
+	cfg.XmlOutput = envToBoolWithDefault("VIRGO4_MARC_INGEST_XML_OUTPUT", false)
+	cfg.Marc8Transcode = envToBoolWithDefault("VIRGO4_MARC_INGEST_MARC8_TRANSCODE", false)
+	cfg.Marc8CodeTables = envWithDefault("VIRGO4_MARC_INGEST_MARC8_CODE_TABLES", "")
+	cfg.RecoverBadRecords = envToBoolWithDefault("VIRGO4_MARC_INGEST_RECOVER_BAD_RECORDS", false)
+	cfg.StrictValidation = envToBoolWithDefault("VIRGO4_MARC_INGEST_STRICT_VALIDATION", false)
+	cfg.MergeControlPolicy = envWithDefault("VIRGO4_MARC_INGEST_MERGE_CONTROL_POLICY", mergeControlFirst)
+	cfg.OversizePolicy = envWithDefault("VIRGO4_MARC_INGEST_OVERSIZE_POLICY", oversizeReject)
+	cfg.DuplicatePolicy = envWithDefault("VIRGO4_MARC_INGEST_DUPLICATE_POLICY", duplicateIgnore)
+	cfg.DeleteListPatterns = envToListWithDefault("VIRGO4_MARC_INGEST_DELETE_LIST_PATTERNS", defaultDeleteListPatterns)
+	cfg.ChangeDetection = envToBoolWithDefault("VIRGO4_MARC_INGEST_CHANGE_DETECTION", false)
+	cfg.StateStore = envWithDefault("VIRGO4_MARC_INGEST_STATE_STORE", "")
+	cfg.CheckpointInterval = envToIntWithDefault("VIRGO4_MARC_INGEST_CHECKPOINT_INTERVAL", 10000)
+	cfg.FullDumpPatterns = envToListWithDefault("VIRGO4_MARC_INGEST_FULL_DUMP_PATTERNS", "")
+	cfg.FullDumpRecordDrop = envToIntWithDefault("VIRGO4_MARC_INGEST_FULL_DUMP_RECORD_DROP", 10)
+	cfg.FullDumpSizeDrop = envToIntWithDefault("VIRGO4_MARC_INGEST_FULL_DUMP_SIZE_DROP", 10)
+	cfg.HoldDir = envWithDefault("VIRGO4_MARC_INGEST_HOLD_DIR", "")
+	if cfg.HoldDir == "" && cfg.StateStore != "" {
+		cfg.HoldDir = filepath.Join(filepath.Dir(cfg.StateStore), "held")
+	}
+	cfg.SourceConfigFile = envWithDefault("VIRGO4_MARC_INGEST_SOURCE_CONFIG", "")
+	cfg.ErrorPolicy = envWithDefault("VIRGO4_MARC_INGEST_ERROR_POLICY", errorPolicyRejectBatch)
+	cfg.RejectBucket = envWithDefault("VIRGO4_MARC_INGEST_REJECT_BUCKET", "")
+	cfg.RejectPrefix = envWithDefault("VIRGO4_MARC_INGEST_REJECT_PREFIX", "rejects")
+	cfg.BadRecordThreshold = envToIntWithDefault("VIRGO4_MARC_INGEST_BAD_RECORD_THRESHOLD", 100)
 	cfg.WorkerQueueSize = envToInt("VIRGO4_MARC_INGEST_WORK_QUEUE_SIZE")
 	cfg.Workers = envToInt("VIRGO4_MARC_INGEST_WORKERS")
+	cfg.ParseWorkers = envToIntWithDefault("VIRGO4_MARC_INGEST_PARSE_WORKERS", runtime.NumCPU())
+	cfg.Pipelines = envToIntWithDefault("VIRGO4_MARC_INGEST_PIPELINES", 1)
 
 	log.Printf("[CONFIG] InQueueName          = [%s]", cfg.InQueueName)
 	log.Printf("[CONFIG] OutQueueName         = [%s]", cfg.OutQueueName)
 	log.Printf("[CONFIG] CacheQueueName       = [%s]", cfg.CacheQueueName)
 	log.Printf("[CONFIG] PollTimeOut          = [%d]", cfg.PollTimeOut)
+	log.Printf("[CONFIG] VisibilityTimeout    = [%d]", cfg.VisibilityTimeout)
+	log.Printf("[CONFIG] EventNames           = [%s]", strings.Join(cfg.EventNames, ","))
 	log.Printf("[CONFIG] DataSource           = [%s]", cfg.DataSource)
 	log.Printf("[CONFIG] MessageBucketName    = [%s]", cfg.MessageBucketName)
+	log.Printf("[CONFIG] StreamIngest         = [%t]", cfg.StreamIngest)
 	log.Printf("[CONFIG] DownloadDir          = [%s]", cfg.DownloadDir)
+	log.Printf("[CONFIG] XmlOutput            = [%t]", cfg.XmlOutput)
+	log.Printf("[CONFIG] Marc8Transcode       = [%t]", cfg.Marc8Transcode)
+	log.Printf("[CONFIG] Marc8CodeTables      = [%s]", cfg.Marc8CodeTables)
+	log.Printf("[CONFIG] RecoverBadRecords    = [%t]", cfg.RecoverBadRecords)
+	log.Printf("[CONFIG] StrictValidation     = [%t]", cfg.StrictValidation)
+	log.Printf("[CONFIG] MergeControlPolicy   = [%s]", cfg.MergeControlPolicy)
+	log.Printf("[CONFIG] OversizePolicy       = [%s]", cfg.OversizePolicy)
+	log.Printf("[CONFIG] DuplicatePolicy      = [%s]", cfg.DuplicatePolicy)
+	log.Printf("[CONFIG] DeleteListPatterns   = [%s]", strings.Join(cfg.DeleteListPatterns, ","))
+	log.Printf("[CONFIG] ChangeDetection      = [%t]", cfg.ChangeDetection)
+	log.Printf("[CONFIG] StateStore           = [%s]", cfg.StateStore)
+	log.Printf("[CONFIG] CheckpointInterval   = [%d]", cfg.CheckpointInterval)
+	log.Printf("[CONFIG] FullDumpPatterns     = [%s]", strings.Join(cfg.FullDumpPatterns, ","))
+	log.Printf("[CONFIG] FullDumpRecordDrop   = [%d]", cfg.FullDumpRecordDrop)
+	log.Printf("[CONFIG] FullDumpSizeDrop     = [%d]", cfg.FullDumpSizeDrop)
+	log.Printf("[CONFIG] HoldDir              = [%s]", cfg.HoldDir)
+	log.Printf("[CONFIG] SourceConfigFile     = [%s]", cfg.SourceConfigFile)
+	log.Printf("[CONFIG] ErrorPolicy          = [%s]", cfg.ErrorPolicy)
+	log.Printf("[CONFIG] RejectBucket         = [%s]", cfg.RejectBucket)
+	log.Printf("[CONFIG] RejectPrefix         = [%s]", cfg.RejectPrefix)
+	log.Printf("[CONFIG] BadRecordThreshold   = [%d]", cfg.BadRecordThreshold)
 	log.Printf("[CONFIG] WorkerQueueSize      = [%d]", cfg.WorkerQueueSize)
 	log.Printf("[CONFIG] Workers              = [%d]", cfg.Workers)
+	log.Printf("[CONFIG] ParseWorkers         = [%d]", cfg.ParseWorkers)
+	log.Printf("[CONFIG] Pipelines            = [%d]", cfg.Pipelines)
 
 	if cfg.CacheQueueName == "" {
 		log.Printf("INFO: cache queue name is blank, record caching is DISABLED!!")
 	}
 
+	switch cfg.ErrorPolicy {
+	case errorPolicyQuarantine:
+	case errorPolicyRejectBatch, errorPolicyRejectFile:
+		// records are published as they are read so we cannot reject a file (or batch) once we find it is invalid
+		if cfg.StreamIngest == true {
+			log.Printf("FATAL ERROR: error policy [%s] is not supported when streaming, use [%s]", cfg.ErrorPolicy, errorPolicyQuarantine)
+			os.Exit(1)
+		}
+	default:
+		log.Printf("FATAL ERROR: unsupported error policy [%s]", cfg.ErrorPolicy)
+		os.Exit(1)
+	}
+
+	// strict validation needs the whole file before anything is published
+	if cfg.StrictValidation == true && cfg.StreamIngest == true {
+		log.Printf("FATAL ERROR: strict validation is not supported when streaming")
+		os.Exit(1)
+	}
+
+	sourceConfigs, err := loadSourceConfigs(cfg.SourceConfigFile)
+	fatalIfError(err)
+	cfg.SourceConfigs = sourceConfigs
+
+	switch cfg.MergeControlPolicy {
+	case mergeControlFirst, mergeControlLast:
+	default:
+		log.Printf("FATAL ERROR: unsupported merge control policy [%s]", cfg.MergeControlPolicy)
+		os.Exit(1)
+	}
+
+	switch cfg.OversizePolicy {
+	case oversizeReject, oversizeFirst, oversizeTruncate:
+	default:
+		log.Printf("FATAL ERROR: unsupported oversize policy [%s]", cfg.OversizePolicy)
+		os.Exit(1)
+	}
+
+	switch cfg.DuplicatePolicy {
+	case duplicateIgnore, duplicateFirst, duplicateReject:
+	case duplicateLast, duplicateMerge:
+		// we only know about later duplicates if the whole batch is validated before it is ingested
+		if cfg.StreamIngest == true {
+			log.Printf("FATAL ERROR: duplicate policy [%s] is not supported when streaming", cfg.DuplicatePolicy)
+			os.Exit(1)
+		}
+	default:
+		log.Printf("FATAL ERROR: unsupported duplicate policy [%s]", cfg.DuplicatePolicy)
+		os.Exit(1)
+	}
+
+	if cfg.ChangeDetection == true && cfg.StateStore == "" {
+		log.Printf("FATAL ERROR: change detection requires a state store")
+		os.Exit(1)
+	}
+
+	if len(cfg.FullDumpPatterns) != 0 && cfg.StateStore == "" {
+		log.Printf("FATAL ERROR: full dump handling requires a state store")
+		os.Exit(1)
+	}
+
+	if cfg.CheckpointInterval < 0 {
+		log.Printf("FATAL ERROR: checkpoint interval cannot be negative")
+		os.Exit(1)
+	}
+
+	// checkpoints are kept in the state store
+	if cfg.CheckpointInterval != 0 && cfg.StateStore == "" {
+		log.Printf("INFO: state store is blank, partially ingested files will not be resumed after a restart")
+	}
+
+	if cfg.FullDumpRecordDrop < 0 || cfg.FullDumpRecordDrop > 100 || cfg.FullDumpSizeDrop < 0 || cfg.FullDumpSizeDrop > 100 {
+		log.Printf("FATAL ERROR: full dump thresholds must be percentages")
+		os.Exit(1)
+	}
+
+	if len(cfg.FullDumpPatterns) != 0 {
+		err = os.MkdirAll(cfg.HoldDir, 0755)
+		fatalIfError(err)
+
+		// full dumps are checked before they are ingested, we cannot count the records in a stream until then
+		if cfg.StreamIngest == true && cfg.FullDumpRecordDrop != 0 {
+			log.Printf("WARNING: full dumps that are streamed are only checked by size, the record threshold is not used")
+		}
+	}
+
+	// the SQS maximum is 12 hours
+	if cfg.VisibilityTimeout < 0 || cfg.VisibilityTimeout > 43200 {
+		log.Printf("FATAL ERROR: visibility timeout must be between 0 and 43200 seconds")
+		os.Exit(1)
+	}
+
+	if cfg.Pipelines < 1 {
+		log.Printf("FATAL ERROR: at least one pipeline is required")
+		os.Exit(1)
+	}
+
+	if cfg.RejectBucket == "" {
+		log.Printf("INFO: reject bucket name is blank, reject reports will be logged only")
+	}
+
 	if cfg.DataSource == "" {
 		log.Printf("INFO: data source name is blank, data source will be determined dynamically")
 	}
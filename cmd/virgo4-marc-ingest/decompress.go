@@ -0,0 +1,374 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// the compression and archive formats we understand
+var compressionNone = "none"
+var compressionGzip = "gzip"
+var compressionBzip2 = "bzip2"
+var compressionZstd = "zstd"
+var archiveZip = "zip"
+var archiveTar = "tar"
+
+// the magic bytes for each of the above
+var gzipMagic = []byte{0x1f, 0x8b}
+var bzip2Magic = []byte("BZh")
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+var zipMagic = []byte("PK\x03\x04")
+var tarMagic = []byte("ustar")
+var tarMagicOffset = 257
+
+// how far into the file we look to identify the compression
+var compressionSniffSize = 512
+
+// guard against archives nested within archives indefinitely
+var maxExpandDepth = 4
+
+// ErrUnsupportedCompression - we cannot decompress this file
+var ErrUnsupportedCompression = fmt.Errorf("unsupported or nested too deeply compressed file")
+
+// ErrCorruptCompressedFile - the compressed file or archive cannot be expanded, typically it is truncated
+var ErrCorruptCompressedFile = fmt.Errorf("corrupt compressed file or archive")
+
+// a problem with the compressed content as opposed to a problem writing the expanded files
+func corruptionError(err error) error {
+	return fmt.Errorf("%w (%s)", ErrCorruptCompressedFile, err.Error())
+}
+
+// is the error a problem with the inbound file itself, such a file can never be expanded
+func isExpansionFailure(err error) bool {
+	return errors.Is(err, ErrCorruptCompressedFile) || errors.Is(err, ErrUnsupportedCompression)
+}
+
+// take a downloaded inbound file and, if it is compressed, decompress it. Archives are expanded with each member
+// becoming a file in its own right. The original file is removed once it is expanded.
+func expandInboundFile(config ServiceConfig, file NameTuple) ([]NameTuple, error) {
+	return expandFile(config, file, 0)
+}
+
+func expandFile(config ServiceConfig, file NameTuple, depth int) ([]NameTuple, error) {
+
+	compression, err := detectCompression(file.LocalName, file.RemoteName)
+	if err != nil {
+		return nil, err
+	}
+
+	if compression == compressionNone {
+		return []NameTuple{file}, nil
+	}
+
+	if depth >= maxExpandDepth {
+		log.Printf("ERROR: %s is nested too deeply", file.RemoteName)
+		return nil, ErrUnsupportedCompression
+	}
+
+	log.Printf("INFO: %s (%s) identified as %s, expanding", file.RemoteName, file.LocalName, compression)
+
+	var expanded []NameTuple
+	switch compression {
+	case archiveZip:
+		expanded, err = expandZip(config, file)
+	case archiveTar:
+		expanded, err = expandTar(config, file)
+	default:
+		var f NameTuple
+		f, err = decompressFile(config, file, compression)
+		expanded = []NameTuple{f}
+	}
+
+	// we no longer need the original
+	if e := os.Remove(file.LocalName); e != nil {
+		log.Printf("WARNING: unable to remove %s (%s)", file.LocalName, e.Error())
+	}
+
+	if err != nil {
+		removeFiles(expanded)
+		return nil, err
+	}
+
+	// the result may itself be compressed (a .tar.gz for example)
+	result := make([]NameTuple, 0, len(expanded))
+	for ix, f := range expanded {
+		files, err := expandFile(config, f, depth+1)
+		if err != nil {
+			removeFiles(result)
+			removeFiles(expanded[ix+1:])
+			return nil, err
+		}
+		result = append(result, files...)
+	}
+
+	return result, nil
+}
+
+// identify the compression from the file contents or, if they are inconclusive, the file name
+func detectCompression(localName string, remoteName string) (string, error) {
+
+	file, err := os.Open(localName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buf := make([]byte, compressionSniffSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	return identifyCompression(buf[0:n], remoteName), nil
+}
+
+// identify the compression from the beginning of the content or, if that is inconclusive, the name
+func identifyCompression(buf []byte, name string) string {
+
+	switch {
+	case bytes.HasPrefix(buf, gzipMagic):
+		return compressionGzip
+	case bytes.HasPrefix(buf, bzip2Magic):
+		return compressionBzip2
+	case bytes.HasPrefix(buf, zstdMagic):
+		return compressionZstd
+	case bytes.HasPrefix(buf, zipMagic):
+		return archiveZip
+	case len(buf) >= tarMagicOffset+len(tarMagic) && bytes.Equal(buf[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic):
+		return archiveTar
+	}
+
+	// fall back to the file suffix, old style tar files do not have the magic
+	if strings.HasSuffix(strings.ToLower(name), ".tar") {
+		return archiveTar
+	}
+
+	return compressionNone
+}
+
+// stream decompress a single compressed file into a new temp file
+func decompressFile(config ServiceConfig, file NameTuple, compression string) (NameTuple, error) {
+
+	in, err := os.Open(file.LocalName)
+	if err != nil {
+		return NameTuple{}, err
+	}
+	defer in.Close()
+
+	reader, err := decompressStream(in, compression)
+	if err != nil {
+		return NameTuple{}, corruptionError(err)
+	}
+	defer reader.Close()
+
+	result := NameTuple{
+		RemoteName: stripCompressionSuffix(file.RemoteName),
+		DataSource: file.DataSource,
+		ObjectSize: file.ObjectSize,
+		ETag:       file.ETag,
+	}
+	result.LocalName, err = expandToTempFile(config.DownloadDir, reader)
+	if err != nil {
+		return NameTuple{}, err
+	}
+
+	return result, nil
+}
+
+// wrap the reader with the appropriate decompressor. Closing the result does not close the underlying reader
+func decompressStream(in io.Reader, compression string) (io.ReadCloser, error) {
+
+	switch compression {
+	case compressionGzip:
+		return gzip.NewReader(in)
+	case compressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(in)), nil
+	case compressionZstd:
+		zs, err := zstd.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		return zs.IOReadCloser(), nil
+	}
+	return nil, ErrUnsupportedCompression
+}
+
+// expand each zip archive member into its own temp file
+func expandZip(config ServiceConfig, file NameTuple) ([]NameTuple, error) {
+
+	archive, err := zip.OpenReader(file.LocalName)
+	if err != nil {
+		return nil, corruptionError(err)
+	}
+	defer archive.Close()
+
+	members := make([]NameTuple, 0)
+	for _, m := range archive.File {
+
+		if m.FileInfo().IsDir() == true || m.UncompressedSize64 == 0 {
+			continue
+		}
+
+		reader, err := m.Open()
+		if err != nil {
+			return members, corruptionError(err)
+		}
+
+		member := newArchiveMember(config, file, m.Name, int64(m.UncompressedSize64))
+		member.LocalName, err = expandToTempFile(config.DownloadDir, reader)
+		reader.Close()
+		if err != nil {
+			return members, err
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// expand each tar archive member into its own temp file
+func expandTar(config ServiceConfig, file NameTuple) ([]NameTuple, error) {
+
+	in, err := os.Open(file.LocalName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	archive := tar.NewReader(in)
+	members := make([]NameTuple, 0)
+	for {
+		hdr, err := archive.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return members, corruptionError(err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			continue
+		}
+
+		member := newArchiveMember(config, file, hdr.Name, hdr.Size)
+		member.LocalName, err = expandToTempFile(config.DownloadDir, archive)
+		if err != nil {
+			return members, err
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+//
+// archive members are named after the archive, and the member name within it. If the member is within a directory,
+// that directory name is used as the data source for the member, otherwise the data source is the one the archive
+// itself would have had. The member has its own size and no ETag, those of the archive do not describe it.
+//
+func newArchiveMember(config ServiceConfig, archive NameTuple, memberName string, memberSize int64) NameTuple {
+
+	memberName = strings.TrimPrefix(path.Clean("/"+memberName), "/")
+	member := NameTuple{
+		RemoteName: fmt.Sprintf("%s/%s", archive.RemoteName, memberName),
+		DataSource: archive.DataSource,
+		ObjectSize: memberSize,
+	}
+
+	if dir := path.Dir(memberName); dir != "." {
+		member.DataSource = strings.Split(dir, "/")[0]
+	} else if member.DataSource == "" {
+		member.DataSource = getDataSource(config.DataSource, archive.RemoteName)
+	}
+
+	log.Printf("INFO: expanding archive member %s (data source %s)", member.RemoteName, member.DataSource)
+	return member
+}
+
+// copy the expanded contents of the reader to a new temp file and return its name. The reader is expanding
+// compressed content so a read failure means the content is corrupt
+func expandToTempFile(dir string, reader io.Reader) (string, error) {
+
+	in := &readFailureReader{reader: reader}
+	name, err := copyToTempFile(dir, in)
+	if err != nil && in.err != nil {
+		return "", corruptionError(in.err)
+	}
+	return name, err
+}
+
+// copy the contents of the reader to a new temp file and return its name
+func copyToTempFile(dir string, reader io.Reader) (string, error) {
+
+	tmp, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(tmp, reader)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// remembers any read failure so it can be told apart from a write failure
+type readFailureReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *readFailureReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// remove the compression suffix from the name, if it has one
+func stripCompressionSuffix(name string) string {
+
+	lower := strings.ToLower(name)
+	for _, suffix := range []string{".gz", ".gzip", ".bz2", ".zst", ".zstd"} {
+		if strings.HasSuffix(lower, suffix) {
+			return name[0 : len(name)-len(suffix)]
+		}
+	}
+	if strings.HasSuffix(lower, ".tgz") {
+		return name[0:len(name)-len(".tgz")] + ".tar"
+	}
+	return name
+}
+
+// remove a set of local files, we are not interested in any errors
+func removeFiles(files []NameTuple) {
+	for _, f := range files {
+		os.Remove(f.LocalName)
+	}
+}
+
+//
+// end of file
+//
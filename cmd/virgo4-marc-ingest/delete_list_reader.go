@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+// the file name patterns that identify delete lists unless configured otherwise
+var defaultDeleteListPatterns = "*.deletes,*.ids"
+
+// the largest line we will accept in a delete list
+var deleteListMaxLineSize = 64 * 1024
+
+// reads delete lists; plain text files containing one record id per line. Blank lines are ignored and anything
+// following a pipe is discarded (Sirsi catkey exports are pipe delimited). For example:
+//
+//	u123456
+//	u123457|
+type deleteListReader struct {
+	DataSource string         // determined from the filename
+	Input      *inputStream   // our input stream
+	Prefix     string         // added to each id that does not already have it (optional)
+	scanner    *bufio.Scanner // our line scanner
+	lineNumber int            // used for reporting
+	byteOffset int64          // used for reporting
+	lastId     string         // the previous id, repeated ids are ignored
+}
+
+func newDeleteListReader(input *inputStream, source string, prefix string) recordReader {
+	r := &deleteListReader{Input: input, DataSource: source, Prefix: prefix}
+	r.reset()
+	return r
+}
+
+// does the base name of the file match any of the patterns, used to identify delete lists and full dumps
+func matchesFileName(patterns []string, name string) bool {
+
+	base := strings.ToLower(path.Base(name))
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToLower(pattern), base)
+		if err == nil && matched == true {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *deleteListReader) rewind() error {
+
+	err := r.Input.rewind()
+	if err != nil {
+		return err
+	}
+
+	// the scanner buffers so we need a new one
+	r.reset()
+	return nil
+}
+
+func (r *deleteListReader) read() (Record, error) {
+
+	for r.scanner.Scan() {
+		lineOffset := r.byteOffset
+		r.byteOffset += int64(len(r.scanner.Bytes()) + 1)
+		r.lineNumber++
+
+		id := r.scanner.Text()
+		if ix := strings.IndexByte(id, '|'); ix != -1 {
+			id = id[0:ix]
+		}
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+
+		if r.Prefix != "" && strings.HasPrefix(id, r.Prefix) == false {
+			id = r.Prefix + id
+		}
+
+		// the same id more than once in succession would look like a continuation record
+		if id == r.lastId {
+			continue
+		}
+		r.lastId = id
+
+		rec := newDeleteRecord(id, r.DataSource)
+		rec.(*recordImpl).offset = lineOffset
+		return rec, nil
+	}
+
+	err := r.scanner.Err()
+	if err != nil {
+		log.Printf("ERROR: delete list read failure after line %d (%s)", r.lineNumber, err.Error())
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// a record that only identifies a record to be deleted
+func newDeleteRecord(id string, source string) Record {
+	return &recordImpl{RawBytes: []byte(id), source: source, marcId: id, format: recordFormatDeleteList}
+}
+
+func (r *deleteListReader) close() {
+	r.Input.close()
+}
+
+func (r *deleteListReader) reset() {
+	r.scanner = bufio.NewScanner(r.Input)
+	r.scanner.Buffer(make([]byte, 0, 64*1024), deleteListMaxLineSize)
+	r.lineNumber = 0
+	r.byteOffset = 0
+	r.lastId = ""
+}
+
+//
+// end of file
+//
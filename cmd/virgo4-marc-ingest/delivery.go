@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// tracks the delivery of the records from a single notification. Each record sent to the workers is counted
+// and the workers confirm delivery once the record has been put on the outbound (and cache) queue, so we know
+// when it is safe to delete the inbound message.
+//
+type deliveryTracker struct {
+	pending sync.WaitGroup // the records sent but not yet delivered
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{}
+}
+
+// how a record sent to the workers is accounted for once it has been delivered
+type recordDelivery struct {
+	tracker    *deliveryTracker // the notification the record came from
+	checkpoint *checkpointer    // the checkpoint of the file the record came from (optional)
+	index      int              // the record index within the file
+	offset     int64            // the record offset within the file
+	change     *recordChange    // the change to the record state (optional)
+}
+
+// send a record to the workers, the change is confirmed once it has been delivered
+func (d *deliveryTracker) send(records chan<- Record, rec Record, change *recordChange) {
+	d.sendFrom(records, rec, change, nil, 0, 0)
+}
+
+// send a record from a file to the workers, the change and the checkpoint are confirmed once it has been delivered
+func (d *deliveryTracker) sendFrom(records chan<- Record, rec Record, change *recordChange, checkpoint *checkpointer, index int, offset int64) {
+
+	if d != nil {
+		d.pending.Add(1)
+		checkpoint.sent(index)
+		rec.SetDelivery(&recordDelivery{tracker: d, checkpoint: checkpoint, index: index, offset: offset, change: change})
+	}
+	records <- rec
+}
+
+// the record has been delivered
+func (r *recordDelivery) delivered() {
+	if r != nil {
+		r.change.confirm()
+		r.checkpoint.confirm(r.index, r.offset)
+		r.tracker.delivered()
+	}
+}
+
+// the record has been delivered
+func (d *deliveryTracker) delivered() {
+	if d != nil {
+		d.pending.Done()
+	}
+}
+
+// wait until every record sent has been delivered
+func (d *deliveryTracker) wait() {
+	if d != nil {
+		d.pending.Wait()
+	}
+}
+
+//
+// keeps inbound messages invisible while they are being processed by periodically extending the visibility
+// timeout, so a long file is not redelivered part way through. If we die, we stop extending it and the
+// message is redelivered once the timeout expires.
+//
+type messageKeeper struct {
+	svc     *sqs.SQS // the SQS helper does not support changing the visibility
+	timeout int64    // the visibility timeout (in seconds)
+}
+
+// a message being kept
+type keptMessage struct {
+	quit chan struct{} // closed to stop extending the visibility
+	done chan struct{} // closed once we have stopped
+	once sync.Once     // we may be released again if we fail after the records have been delivered
+}
+
+func newMessageKeeper(cfg ServiceConfig) (*messageKeeper, error) {
+
+	if cfg.VisibilityTimeout == 0 {
+		return nil, nil
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &messageKeeper{svc: sqs.New(sess), timeout: int64(cfg.VisibilityTimeout)}, nil
+}
+
+// start extending the visibility of the message, it is extended now and then every half timeout
+func (k *messageKeeper) keep(queue awssqs.QueueHandle, receiptHandle awssqs.ReceiptHandle) *keptMessage {
+
+	if k == nil {
+		return nil
+	}
+
+	m := &keptMessage{quit: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(time.Duration(k.timeout) * time.Second / 2)
+		defer ticker.Stop()
+
+		for {
+			_, err := k.svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(string(queue)),
+				ReceiptHandle:     aws.String(string(receiptHandle)),
+				VisibilityTimeout: aws.Int64(k.timeout),
+			})
+			if err != nil {
+				log.Printf("WARNING: unable to extend inbound message visibility (%s)", err.Error())
+			}
+
+			select {
+			case <-ticker.C:
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// stop extending the visibility
+func (m *keptMessage) release() {
+	if m != nil {
+		m.once.Do(func() { close(m.quit) })
+		<-m.done
+	}
+}
+
+//
+// end of file
+//
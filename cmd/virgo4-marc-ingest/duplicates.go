@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// what we do with records that have the same id as an earlier record in the same file or notification batch
+var duplicateIgnore = "ignore" // nothing, every record is ingested and the last one wins downstream (the original behavior)
+var duplicateFirst = "first"   // only the first occurrence is ingested
+var duplicateLast = "last"     // only the last occurrence is ingested
+var duplicateMerge = "merge"   // all occurrences are merged into a single record
+var duplicateReject = "reject" // duplicates are bad records
+
+// ErrDuplicateRecord - a record id appears more than once
+var ErrDuplicateRecord = fmt.Errorf("duplicate record id")
+
+// ErrDuplicateMismatch - ingest found the records of a file in a different order than validation did
+var ErrDuplicateMismatch = fmt.Errorf("records do not match those noted during validation")
+
+//
+// where a record appears; the file number (files are numbered in the order they are noted) and the record number
+// within the file after any continuation records have been merged and bad records skipped. Validation and ingest
+// read a file with the same loader settings so they see the same records with the same numbers, resolve checks
+// that this holds.
+//
+type recordOccurrence struct {
+	file  int32
+	index int32
+}
+
+// does this occurrence come before the other one
+func (o recordOccurrence) before(other recordOccurrence) bool {
+	return o.file < other.file || (o.file == other.file && o.index < other.index)
+}
+
+//
+// tracks record ids across all the files in a notification batch. The ids are noted during validation which
+// means that, when we ingest, we know if a record has a duplicate later on. When streaming there is no validation
+// so we can only know about duplicates we have already seen. Batches can contain millions of records so, for
+// each id, we only keep the occurrence the policy publishes; the first one, or the last one when keeping or
+// merging into the last.
+//
+type duplicateTracker struct {
+	config      ServiceConfig               // for the policy and merging
+	files       map[string]int32            // the file numbers
+	names       []string                    // the file names by number, for reporting
+	occurrences map[string]recordOccurrence // the occurrence of each id that is published
+	pending     map[string]recordOccurrence // as above for the file being validated, kept apart until it is accepted
+	pendingFile string                      // the file being validated
+	counts      map[string]int              // the number of duplicates found in each file
+	stashed     map[string]Record           // the records waiting for the last occurrence when merging
+}
+
+func newDuplicateTracker(config ServiceConfig) *duplicateTracker {
+
+	return &duplicateTracker{
+		config:      config,
+		files:       make(map[string]int32),
+		occurrences: make(map[string]recordOccurrence),
+		pending:     make(map[string]recordOccurrence),
+		counts:      make(map[string]int),
+		stashed:     make(map[string]Record),
+	}
+}
+
+// the number of the file, it is numbered if it has not been seen before
+func (t *duplicateTracker) fileNumber(file string) int32 {
+
+	number, found := t.files[file]
+	if found == false {
+		number = int32(len(t.names))
+		t.files[file] = number
+		t.names = append(t.names, file)
+	}
+	return number
+}
+
+// the occurrence of the id that is published
+func (t *duplicateTracker) occurrence(id string) (recordOccurrence, bool) {
+
+	o, found := t.pending[id]
+	if found == false {
+		o, found = t.occurrences[id]
+	}
+	return o, found
+}
+
+// do we publish the last occurrence of an id rather than the first
+func (t *duplicateTracker) keepsLast() bool {
+	return t.config.DuplicatePolicy == duplicateLast || t.config.DuplicatePolicy == duplicateMerge
+}
+
+// note a record id, returns true if we have seen it before
+func (t *duplicateTracker) note(file string, index int, id string) bool {
+
+	if t == nil || t.config.DuplicatePolicy == duplicateIgnore {
+		return false
+	}
+
+	// a file that was neither accepted nor forgotten is accepted
+	if file != t.pendingFile {
+		t.accept(t.pendingFile)
+		t.pendingFile = file
+	}
+
+	this := recordOccurrence{file: t.fileNumber(file), index: int32(index)}
+	previous, found := t.occurrence(id)
+	if found == false || t.keepsLast() == true {
+		t.pending[id] = this
+	}
+	if found == false {
+		return false
+	}
+
+	t.counts[file]++
+	log.Printf("WARNING: record %s in %s (record %d) duplicates one in %s (record %d)", id, file, index, t.names[previous.file], previous.index)
+	return true
+}
+
+// the file has been validated and will be ingested
+func (t *duplicateTracker) accept(file string) {
+
+	if t == nil || file != t.pendingFile || len(t.pending) == 0 {
+		return
+	}
+
+	// the first file is usually the only one
+	if len(t.occurrences) == 0 {
+		t.occurrences = t.pending
+	} else {
+		for id, o := range t.pending {
+			t.occurrences[id] = o
+		}
+	}
+	t.pending = make(map[string]recordOccurrence)
+}
+
+// forget everything we know about a file, used when a file is rejected and will not be ingested. A file is
+// rejected once it has been validated, before the next one is
+func (t *duplicateTracker) forget(file string) {
+
+	if t == nil {
+		return
+	}
+
+	if file == t.pendingFile {
+		t.pending = make(map[string]recordOccurrence)
+	} else if number, found := t.files[file]; found == true {
+		log.Printf("WARNING: forgetting record ids from %s after it was accepted", file)
+		for id, o := range t.occurrences {
+			if o.file == number {
+				delete(t.occurrences, id)
+			}
+		}
+	}
+	delete(t.counts, file)
+}
+
+// the number of duplicates found in the specified file
+func (t *duplicateTracker) duplicates(file string) int {
+	if t == nil {
+		return 0
+	}
+	return t.counts[file]
+}
+
+//
+// decide what to do with a record during ingest according to the duplicate policy. Returns the record to be
+// published, nil if nothing should be published
+//
+func (t *duplicateTracker) resolve(file string, index int, rec Record) (Record, error) {
+
+	if t == nil || t.config.DuplicatePolicy == duplicateIgnore {
+		return rec, nil
+	}
+
+	id, _ := rec.Id()
+
+	// when streaming we have not seen the record during validation so we note it now
+	if t.config.StreamIngest == true {
+		t.note(file, index, id)
+	}
+
+	published, found := t.occurrence(id)
+	if found == false {
+		log.Printf("ERROR: record %s in %s (record %d) was not noted during validation", id, file, index)
+		return nil, ErrDuplicateMismatch
+	}
+
+	this := recordOccurrence{file: t.fileNumber(file), index: int32(index)}
+	if this == published && t.config.DuplicatePolicy != duplicateMerge {
+		return rec, nil
+	}
+
+	// the first occurrence cannot come after this one and the last cannot come before it
+	if (t.keepsLast() == false && this.before(published) == true) || (t.keepsLast() == true && published.before(this) == true) {
+		log.Printf("ERROR: record %s in %s (record %d) does not match the occurrence noted during validation (%s record %d)", id, file,
+			index, t.names[published.file], published.index)
+		return nil, ErrDuplicateMismatch
+	}
+
+	if t.config.DuplicatePolicy == duplicateMerge {
+		stashed, ok := t.stashed[id]
+		if ok == true {
+			merged, err := mergeRecords(t.config, stashed, rec)
+			if err != nil {
+				log.Printf("ERROR: unable to merge duplicate record %s, using the latest occurrence (%s)", id, err.Error())
+			} else {
+				rec = merged
+			}
+		}
+
+		if this == published {
+			delete(t.stashed, id)
+			return rec, nil
+		}
+		t.stashed[id] = rec
+	}
+
+	log.Printf("INFO: not publishing duplicate record %s from %s (record %d), policy is %s", id, file, index, t.config.DuplicatePolicy)
+	return nil, nil
+}
+
+//
+// end of file
+//
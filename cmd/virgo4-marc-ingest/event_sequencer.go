@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+//
+// S3 events for the same object may be delivered more than once and out of order. Each event has a sequencer,
+// a later event for the same object has a greater sequencer, so we keep the sequencer of the last event we
+// processed for each object and ignore any that are older. The sequencers are kept in the state store if there
+// is one, otherwise they are forgotten when we restart.
+//
+type eventSequencer struct {
+	store  *stateStore       // where the sequencers are kept (optional)
+	lock   sync.Mutex        // notifications are processed concurrently
+	latest map[string]string // the sequencers when there is no store
+}
+
+func newEventSequencer(store *stateStore) *eventSequencer {
+	return &eventSequencer{store: store, latest: make(map[string]string)}
+}
+
+// is the event older than (or the same as) one we have already processed
+func (s *eventSequencer) stale(f InboundFile) (bool, error) {
+
+	if s == nil || f.Sequencer == "" {
+		return false, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	latest, err := s.get(eventObjectName(f))
+	if err != nil {
+		return false, err
+	}
+	return latest != "" && compareSequencers(f.Sequencer, latest) <= 0, nil
+}
+
+// note that we have processed the events for the files
+func (s *eventSequencer) processed(files []InboundFile) error {
+
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, f := range files {
+		if f.Sequencer == "" {
+			continue
+		}
+
+		name := eventObjectName(f)
+		latest, err := s.get(name)
+		if err != nil {
+			return err
+		}
+		if latest != "" && compareSequencers(f.Sequencer, latest) <= 0 {
+			continue
+		}
+
+		if s.store == nil {
+			s.latest[name] = f.Sequencer
+			continue
+		}
+		err = s.store.setEventSequencer(name, f.Sequencer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the files whose events are not stale
+func (s *eventSequencer) current(files []InboundFile) ([]InboundFile, error) {
+
+	result := make([]InboundFile, 0, len(files))
+	for _, f := range files {
+		stale, err := s.stale(f)
+		if err != nil {
+			return nil, err
+		}
+		if stale == true {
+			log.Printf("INFO: ignoring stale event for %s/%s (sequencer %s)", f.SourceBucket, f.SourceKey, f.Sequencer)
+			continue
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// the sequencer of the last event processed for the object, blank if there has not been one
+func (s *eventSequencer) get(name string) (string, error) {
+
+	if s.store == nil {
+		return s.latest[name], nil
+	}
+	return s.store.eventSequencer(name)
+}
+
+// events are per object, not per version
+func eventObjectName(f InboundFile) string {
+	return fmt.Sprintf("%s/%s", f.SourceBucket, f.SourceKey)
+}
+
+// compare two sequencers, they are hex strings that may be of different lengths so the shorter one is padded with
+// leading zeros
+func compareSequencers(a string, b string) int {
+
+	a = strings.ToUpper(a)
+	b = strings.ToUpper(b)
+	if len(a) < len(b) {
+		a = strings.Repeat("0", len(b)-len(a)) + a
+	} else if len(b) < len(a) {
+		b = strings.Repeat("0", len(a)-len(b)) + b
+	}
+	return strings.Compare(a, b)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// filter actions
+var filterExclude = "exclude" // records that match are not published
+var filterInclude = "include" // only records that match (any of the include rules) are published
+
+// FilterRule - decides if a record is published. A rule matches either a leader position or a field (optionally
+// a subfield) whose value matches an expression. For example:
+//
+//	{ "name": "authority", "leader_position": 6, "values": "z" }
+//	{ "name": "vendor", "tag": "035", "subfield": "a", "match": "^\\(VENDOR\\)" }
+//	{ "name": "suppressed", "tag": "999", "subfield": "x", "match": "^SUPPRESS" }
+type FilterRule struct {
+	Name           string `json:"name"`            // used for reporting
+	Action         string `json:"action"`          // include or exclude (the default)
+	LeaderPosition *int   `json:"leader_position"` // the leader position to test
+	Values         string `json:"values"`          // the leader values that match
+	Tag            string `json:"tag"`             // the field tag to test
+	Subfield       string `json:"subfield"`        // the subfield code (data fields only), blank to use the entire field
+	Match          string `json:"match"`           // a regular expression, blank to match any field with the tag
+
+	matchExpr *regexp.Regexp // the compiled form of the above
+}
+
+// applies the filter rules to records and keeps count of the records each rule filtered
+type recordFilter struct {
+	rules    []FilterRule   // the rules in order
+	includes bool           // do we have any include rules
+	counts   map[string]int // the number of records each rule filtered
+	excluded int            // the number of records not matching any include rule
+}
+
+// validate the rule and compile any expressions
+func (rule *FilterRule) prepare() error {
+
+	if rule.Action == "" {
+		rule.Action = filterExclude
+	}
+	if rule.Action != filterExclude && rule.Action != filterInclude {
+		return fmt.Errorf("filter %s action is invalid (%s)", rule.Name, rule.Action)
+	}
+
+	if rule.LeaderPosition != nil {
+		if *rule.LeaderPosition < 0 || *rule.LeaderPosition >= marcRecordLeaderSize || rule.Values == "" {
+			return fmt.Errorf("filter %s leader position or values are invalid", rule.Name)
+		}
+	} else if len(rule.Tag) != 3 {
+		return fmt.Errorf("filter %s requires a leader position or a tag", rule.Name)
+	}
+
+	if rule.Match != "" {
+		expr, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return err
+		}
+		rule.matchExpr = expr
+	}
+
+	if rule.Name == "" {
+		rule.Name = rule.String()
+	}
+	return nil
+}
+
+// does the rule match the record
+func (rule FilterRule) matches(parsed *marcRecord) bool {
+
+	if rule.LeaderPosition != nil {
+		pos := *rule.LeaderPosition
+		return pos < len(parsed.leader) && strings.IndexByte(rule.Values, parsed.leader[pos]) != -1
+	}
+
+	for _, f := range parsed.getFields(rule.Tag) {
+
+		var values []string
+		if f.IsControl() == true || rule.Subfield == "" {
+			values = []string{f.data()}
+		} else {
+			for _, sf := range f.Subfields {
+				if sf.Code == rule.Subfield {
+					values = append(values, sf.Value)
+				}
+			}
+		}
+
+		for _, value := range values {
+			if rule.matchExpr == nil || rule.matchExpr.MatchString(value) == true {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// describe the rule for reporting
+func (rule FilterRule) String() string {
+
+	if rule.LeaderPosition != nil {
+		return fmt.Sprintf("leader/%02d in [%s]", *rule.LeaderPosition, rule.Values)
+	}
+	s := rule.Tag
+	if rule.Subfield != "" {
+		s += "$" + rule.Subfield
+	}
+	if rule.Match != "" {
+		s += fmt.Sprintf(" matches %s", rule.Match)
+	}
+	return s
+}
+
+func newRecordFilter(rules []FilterRule) *recordFilter {
+
+	f := &recordFilter{rules: rules, counts: make(map[string]int)}
+	for _, rule := range rules {
+		if rule.Action == filterInclude {
+			f.includes = true
+		}
+	}
+	return f
+}
+
+// should the record be published. Deleted records and records we cannot parse are always published
+func (f *recordFilter) publish(rec Record) bool {
+
+	if len(f.rules) == 0 || rec.Deleted() == true {
+		return true
+	}
+
+	parsed, err := rec.(*recordImpl).parse()
+	if err != nil {
+		return true
+	}
+
+	included := false
+	for _, rule := range f.rules {
+		if rule.matches(parsed) == false {
+			continue
+		}
+		if rule.Action == filterExclude {
+			f.counts[rule.Name]++
+			return false
+		}
+		included = true
+	}
+
+	if f.includes == true && included == false {
+		f.excluded++
+		return false
+	}
+	return true
+}
+
+// report the number of records filtered by each rule
+func (f *recordFilter) report(name string) {
+
+	for _, rule := range f.rules {
+		if count := f.counts[rule.Name]; count != 0 {
+			log.Printf("INFO: %s: %d record(s) filtered by rule %s", name, count, rule.Name)
+		}
+	}
+	if f.excluded != 0 {
+		log.Printf("INFO: %s: %d record(s) filtered as they matched no include rule", name, f.excluded)
+	}
+}
+
+//
+// end of file
+//
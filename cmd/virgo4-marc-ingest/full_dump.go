@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrHeldDumpOutOfDate - another full dump for the data source was accepted after this one was held
+var ErrHeldDumpOutOfDate = fmt.Errorf("another full dump has been accepted since this one was held")
+
+// the number of record ids we accumulate before writing them to the state store
+var fullDumpFlushSize = 10000
+
+// full dumps for the same data source are ingested one at a time, several pipelines may be ingesting at once
+var fullDumpSources = newSourceLocks()
+
+// the data sources that are locked
+type sourceLocks struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	locked map[string]bool
+}
+
+//
+// reconciles a full dump (a file containing every record for a data source) with the previous full dump for the
+// same data source. The ids of the records in the dump are kept in the state store and, once the whole file has
+// been ingested, a delete is published for every record in the previous dump that is not in this one. A dump
+// that looks suspicious is held before any of it is published (see holdSuspiciousFullDump).
+//
+type fullDumpReconciler struct {
+	store    *stateStore   // where the record ids are kept
+	source   string        // the data source
+	file     string        // the file being ingested
+	size     int64         // the size of the object the file came from
+	bucket   string        // where we keep the record ids for this dump
+	previous fullDumpState // the previous dump for this data source
+	pending  []string      // record ids not yet written to the store
+	records  int           // the number of record ids in this dump
+	locked   bool          // do we have the data source locked
+}
+
+// is the file a full dump that we reconcile
+func isFullDump(cfg ServiceConfig, store *stateStore, source string, file NameTuple) bool {
+
+	if store == nil || matchesFileName(cfg.FullDumpPatterns, file.RemoteName) == false {
+		return false
+	}
+
+	if source == "" {
+		log.Printf("WARNING: %s is a full dump but the data source is unknown, it will not be reconciled", file.RemoteName)
+		return false
+	}
+	return true
+}
+
+// start reconciling a full dump, returns nil if the file is not a full dump
+func newFullDumpReconciler(cfg ServiceConfig, store *stateStore, source string, file NameTuple) (*fullDumpReconciler, error) {
+
+	if isFullDump(cfg, store, source, file) == false {
+		return nil, nil
+	}
+
+	// another pipeline may be ingesting a full dump for the same data source
+	if fullDumpSources.tryAcquire(source) == false {
+		log.Printf("INFO: %s is a full dump for %s, waiting for the one being ingested", file.RemoteName, source)
+		fullDumpSources.acquire(source)
+	}
+
+	previous, found, err := store.fullDumpState(source)
+	if err != nil {
+		fullDumpSources.release(source)
+		return nil, err
+	}
+
+	// an approved dump was compared with the dump that was current when it was held
+	if file.held != nil && previous.Bucket != file.held.Previous.Bucket {
+		fullDumpSources.release(source)
+		return nil, ErrHeldDumpOutOfDate
+	}
+
+	if found == true {
+		log.Printf("INFO: %s is a full dump for %s, the previous full dump was %s (%d records)", file.RemoteName, source, previous.File, previous.Records)
+	} else {
+		log.Printf("INFO: %s is the first full dump for %s", file.RemoteName, source)
+	}
+
+	return &fullDumpReconciler{
+		store:    store,
+		source:   source,
+		file:     file.RemoteName,
+		size:     file.ObjectSize,
+		bucket:   fmt.Sprintf("%s%s/%d", fullDumpBucketPrefix, source, time.Now().UnixNano()),
+		previous: previous,
+		pending:  make([]string, 0, fullDumpFlushSize),
+		locked:   true,
+	}, nil
+}
+
+// note a record id that is in the dump
+func (r *fullDumpReconciler) seen(rec Record) error {
+
+	if r == nil {
+		return nil
+	}
+
+	id, err := rec.Id()
+	if err != nil {
+		return err
+	}
+
+	r.pending = append(r.pending, id)
+	r.records++
+	if len(r.pending) < fullDumpFlushSize {
+		return nil
+	}
+	return r.flush()
+}
+
+func (r *fullDumpReconciler) flush() error {
+
+	err := r.store.addFullDumpIds(r.bucket, r.pending)
+	if err != nil {
+		return err
+	}
+	r.pending = r.pending[:0]
+	return nil
+}
+
+// the dump has been ingested, publish deletes for the records that have vanished and make this the current dump
+func (r *fullDumpReconciler) finish(batch *ingestBatch, records chan<- Record) (int, error) {
+
+	if r == nil {
+		return 0, nil
+	}
+	defer r.unlock()
+
+	err := r.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	state := fullDumpState{Bucket: r.bucket, File: r.file, Records: r.records, Size: r.size}
+	return reconcileFullDump(r.store, batch.changes, batch.delivery, r.source, r.previous, state, records)
+}
+
+// publish deletes for the records in the previous dump that are not in this one and, once they have been
+// delivered, make this the current dump. Returns the number of deletes
+func reconcileFullDump(store *stateStore, changes *changeDetector, delivery *deliveryTracker, source string, previous fullDumpState, state fullDumpState, records chan<- Record) (int, error) {
+
+	var err error
+	vanished := make([]string, 0)
+	if previous.Bucket != "" {
+		vanished, err = store.vanishedIds(previous.Bucket, state.Bucket)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, id := range vanished {
+		rec := newDeleteRecord(id, source)
+
+		// so the record is published if it comes back
+		change, err := changes.changed(state.File, rec)
+		if err != nil {
+			return 0, err
+		}
+		delivery.send(records, rec, change)
+	}
+
+	// if we fail before the deletes are delivered, the previous dump is still the current one and they are
+	// published again when the dump is redelivered
+	delivery.wait()
+
+	state.Accepted = time.Now()
+	err = store.acceptFullDump(source, state, previous.Bucket)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("INFO: full dump %s for %s accepted, %d records, %d deleted", state.File, source, state.Records, len(vanished))
+	return len(vanished), nil
+}
+
+// compare a file that is about to be ingested with the previous full dump for the data source, returns the
+// description of the dump to hold if it looks suspicious or nil if it does not (or it is not a full dump). The
+// number of records is the number in the file, 0 if we do not know it before the file is ingested
+func checkFullDumpFile(cfg ServiceConfig, store *stateStore, source string, file NameTuple, records int) (*heldDump, error) {
+
+	// an approved dump has already been checked
+	if file.held != nil || isFullDump(cfg, store, source, file) == false {
+		return nil, nil
+	}
+
+	previous, _, err := store.fullDumpState(source)
+	if err != nil {
+		return nil, err
+	}
+
+	reason := checkFullDump(cfg, previous, fullDumpState{File: file.RemoteName, Records: records, Size: file.ObjectSize})
+	if reason == "" {
+		return nil, nil
+	}
+
+	log.Printf("WARNING: full dump %s for %s is suspicious (%s), holding it", file.RemoteName, source, reason)
+	return &heldDump{
+		Source:     source,
+		File:       file.RemoteName,
+		DataSource: file.DataSource,
+		ETag:       file.ETag,
+		Records:    records,
+		Size:       file.ObjectSize,
+		Previous:   previous,
+		Reason:     reason,
+		Status:     holdStatusHeld,
+		Held:       time.Now(),
+	}, nil
+}
+
+// compare a full dump with the previous one for the data source, returns why the dump is suspicious or blank if
+// it is not. A dump with no record count is only compared by size
+func checkFullDump(cfg ServiceConfig, previous fullDumpState, state fullDumpState) string {
+
+	if cfg.FullDumpRecordDrop != 0 && previous.Records != 0 && state.Records != 0 {
+		if state.Records*100 < previous.Records*(100-cfg.FullDumpRecordDrop) {
+			return fmt.Sprintf("%d records, the previous dump %s had %d", state.Records, previous.File, previous.Records)
+		}
+	}
+
+	// dumps accepted before we recorded the size have none
+	if cfg.FullDumpSizeDrop != 0 && previous.Size != 0 && state.Size != 0 {
+		if state.Size*100 < previous.Size*int64(100-cfg.FullDumpSizeDrop) {
+			return fmt.Sprintf("%d bytes, the previous dump %s was %d bytes", state.Size, previous.File, previous.Size)
+		}
+	}
+
+	return ""
+}
+
+// the dump could not be ingested, forget about it. The previous dump remains the current one
+func (r *fullDumpReconciler) abandon() {
+
+	if r == nil {
+		return
+	}
+
+	log.Printf("WARNING: abandoning full dump %s for %s", r.file, r.source)
+	err := r.store.removeFullDump(r.bucket)
+	if err != nil {
+		log.Printf("ERROR: unable to remove full dump state %s (%s)", r.bucket, err.Error())
+	}
+	r.unlock()
+}
+
+// let the next full dump for the data source proceed
+func (r *fullDumpReconciler) unlock() {
+
+	if r.locked == true {
+		fullDumpSources.release(r.source)
+		r.locked = false
+	}
+}
+
+func newSourceLocks() *sourceLocks {
+
+	l := &sourceLocks{locked: make(map[string]bool)}
+	l.cond = sync.NewCond(&l.lock)
+	return l
+}
+
+// lock the data source, waiting until it is available
+func (l *sourceLocks) acquire(source string) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for l.locked[source] == true {
+		l.cond.Wait()
+	}
+	l.locked[source] = true
+}
+
+// lock the data source if it is available, returns false if it is not
+func (l *sourceLocks) tryAcquire(source string) bool {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.locked[source] == true {
+		return false
+	}
+	l.locked[source] = true
+	return true
+}
+
+func (l *sourceLocks) release(source string) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.locked, source)
+	l.cond.Broadcast()
+}
+
+//
+// end of file
+//
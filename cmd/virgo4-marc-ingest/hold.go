@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+// the status of a held full dump
+var holdStatusHeld = "held"         // waiting for an operator
+var holdStatusApproved = "approved" // the dump is OK, it will be ingested and the records missing from it deleted
+var holdStatusRejected = "rejected" // the dump is not OK, it will be discarded
+
+//
+// a full dump that looks suspicious, typically because it is much smaller than the previous one (a truncated
+// upload for example). Nothing in the dump is published until an operator approves it, a copy of the file is
+// kept in the hold directory along with a file per held dump that the operator updates (see the hold command).
+//
+type heldDump struct {
+	Source     string        `json:"source"`     // the data source
+	File       string        `json:"file"`       // the file the dump was loaded from
+	DataSource string        `json:"datasource"` // the data source override of the file, if any
+	ETag       string        `json:"etag"`       // the ETag of the object the file came from
+	LocalName  string        `json:"local"`      // the copy of the file we are holding
+	Records    int           `json:"records"`    // the number of records in the file (0 if it was streamed)
+	Size       int64         `json:"size"`       // the size of the object the dump was loaded from
+	Previous   fullDumpState `json:"previous"`   // the previous dump for the data source
+	Reason     string        `json:"reason"`     // why the dump was held
+	Status     string        `json:"status"`     // held, approved or rejected
+	Held       time.Time     `json:"held"`       // when the dump was held
+}
+
+// hold a full dump until an operator approves or rejects it, the content is copied to the hold directory
+func holdFullDump(cfg ServiceConfig, store *stateStore, held heldDump, content io.Reader) error {
+
+	held.LocalName = filepath.Join(cfg.HoldDir, fmt.Sprintf("%s-%d.dat", held.Source, held.Held.UnixNano()))
+	err := writeHeldContent(held.LocalName, content)
+	if err != nil {
+		os.Remove(held.LocalName)
+		return err
+	}
+
+	replaced, found, err := store.holdFullDump(held)
+	if err != nil {
+		os.Remove(held.LocalName)
+		return err
+	}
+
+	if found == true {
+		log.Printf("WARNING: replacing held full dump %s for %s", replaced.File, held.Source)
+		err = os.Remove(replaced.LocalName)
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	}
+
+	return writeHeldDump(cfg.HoldDir, held)
+}
+
+// hold a full dump that has been downloaded
+func holdLocalFile(cfg ServiceConfig, store *stateStore, held heldDump, localName string) error {
+
+	file, err := os.Open(localName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return holdFullDump(cfg, store, held, file)
+}
+
+func writeHeldContent(filename string, content io.Reader) error {
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, content)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// the file describing the dump held for the data source
+func heldDumpFile(holdDir string, source string) string {
+	return filepath.Join(holdDir, fmt.Sprintf("%s.json", source))
+}
+
+// write the held dump file, it is replaced atomically so a partial file is never seen
+func writeHeldDump(holdDir string, held heldDump) error {
+
+	buf, err := json.MarshalIndent(held, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := heldDumpFile(holdDir, held.Source)
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func readHeldDump(holdDir string, source string) (heldDump, error) {
+
+	var held heldDump
+	buf, err := ioutil.ReadFile(heldDumpFile(holdDir, source))
+	if err != nil {
+		return held, err
+	}
+	err = json.Unmarshal(buf, &held)
+	return held, err
+}
+
+// act on any operator decisions about held full dumps. Approved dumps are ingested and rejected ones are
+// discarded. A dump we cannot act on is reported and left until next time
+func processHeldDumps(cfg ServiceConfig, store *stateStore, pipelines *ingestPipelines) error {
+
+	if store == nil {
+		return nil
+	}
+
+	held, err := store.heldDumps()
+	if err != nil {
+		return err
+	}
+
+	for _, h := range held {
+
+		// the dump may already be being ingested
+		if pipelines.heldInProgress(h.Source) == true {
+			continue
+		}
+
+		// we come back to it once any full dump being ingested for the data source is done
+		if fullDumpSources.tryAcquire(h.Source) == false {
+			continue
+		}
+
+		approved, err := processHeldDump(cfg, store, h)
+		fullDumpSources.release(h.Source)
+
+		// the dump is ingested in a pipeline like any other file, if none is free we come back to it
+		if err == nil && approved == true {
+			pipelines.startHeld(h)
+		}
+		if err != nil {
+			log.Printf("ERROR: unable to process held full dump %s for %s (%s)", h.File, h.Source, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// act on any operator decision about a held full dump, returns true if the dump has been approved and should
+// be ingested
+func processHeldDump(cfg ServiceConfig, store *stateStore, h heldDump) (bool, error) {
+
+	decision, err := readHeldDump(cfg.HoldDir, h.Source)
+	if err != nil {
+		// the operator should not remove the file but, if they do, we put it back
+		if os.IsNotExist(err) == true {
+			log.Printf("WARNING: held full dump file for %s is missing, rewriting it", h.Source)
+			return false, writeHeldDump(cfg.HoldDir, h)
+		}
+
+		// the operator may be part way through editing it
+		log.Printf("WARNING: held full dump file for %s cannot be read, ignoring it for now (%s)", h.Source, err.Error())
+		return false, nil
+	}
+
+	// the file may describe an earlier dump that has since been replaced
+	if decision.LocalName != h.LocalName || decision.Status == holdStatusHeld {
+		return false, nil
+	}
+
+	switch decision.Status {
+	case holdStatusApproved:
+		// another dump may have been accepted since this one was held, it would be wrong to reconcile with that
+		current, _, err := store.fullDumpState(h.Source)
+		if err != nil {
+			return false, err
+		}
+		if current.Bucket != h.Previous.Bucket {
+			log.Printf("WARNING: full dump %s for %s is out of date, discarding it", h.File, h.Source)
+			return false, forgetHeldDump(cfg, store, h)
+		}
+
+		log.Printf("INFO: held full dump %s for %s approved", h.File, h.Source)
+		return true, nil
+
+	case holdStatusRejected:
+		log.Printf("INFO: held full dump %s for %s rejected", h.File, h.Source)
+		return false, forgetHeldDump(cfg, store, h)
+
+	default:
+		log.Printf("WARNING: held full dump %s for %s has an unsupported status [%s]", h.File, h.Source, decision.Status)
+		return false, nil
+	}
+}
+
+// ingest an approved full dump from the copy we are holding, it is validated again so the record ids are noted.
+// If it is not valid, the dump is rejected
+func ingestHeldDump(cfg ServiceConfig, store *stateStore, s3Svc uva_s3.UvaS3, h heldDump, records chan<- Record) error {
+
+	start := time.Now()
+	log.Printf("INFO: processing held full dump %s (%s)", h.File, h.LocalName)
+
+	file := NameTuple{LocalName: h.LocalName, RemoteName: h.File, DataSource: h.DataSource, ObjectSize: h.Size, ETag: h.ETag, held: &h}
+	fileCfg := fileConfig(cfg, file)
+	batch := newIngestBatch(cfg, store)
+
+	loader, err := NewRecordLoader(fileCfg, file.RemoteName, file.LocalName)
+	if err != nil {
+		return err
+	}
+	loader.TrackDuplicates(batch.duplicates)
+	err = loader.Validate()
+	badRecords := loader.BadRecords()
+	file.index = loader.Index()
+	loader.Done()
+
+	// we try again if we could not read it
+	if err != nil && isReadFailure(err) == true {
+		return err
+	}
+
+	// when quarantining, too many bad records means we reject the file anyway
+	if err == nil && cfg.ErrorPolicy == errorPolicyQuarantine && len(badRecords) > cfg.BadRecordThreshold {
+		log.Printf("ERROR: %s (%s) has %d bad records, threshold is %d", file.RemoteName, file.LocalName, len(badRecords), cfg.BadRecordThreshold)
+		err = ErrTooManyBadRecords
+	}
+
+	if err != nil {
+		log.Printf("ERROR: held full dump %s for %s appears to be invalid, rejecting it (%s)", h.File, h.Source, err.Error())
+		r := writeRejectReport(cfg, s3Svc, RejectReport{File: file.RemoteName, Rejected: true, Reason: err.Error(), BadRecords: badRecords})
+		if r != nil {
+			return r
+		}
+
+		// the rejection is acted on like an operator decision
+		h.Status = holdStatusRejected
+		return writeHeldDump(cfg.HoldDir, h)
+	}
+	batch.duplicates.accept(file.RemoteName)
+
+	if len(badRecords) != 0 {
+		err = writeRejectReport(cfg, s3Svc, RejectReport{File: file.RemoteName, BadRecords: badRecords})
+		if err != nil {
+			return err
+		}
+	}
+
+	loader, err = NewRecordLoader(fileCfg, file.RemoteName, file.LocalName)
+	if err != nil {
+		return err
+	}
+	loader.UseIndex(file.index)
+	count, err := ingestRecords(fileCfg, file, loader, batch, records)
+	loader.Done()
+
+	if err == ErrHeldDumpOutOfDate {
+		log.Printf("WARNING: full dump %s for %s is out of date, discarding it", h.File, h.Source)
+		return forgetHeldDump(cfg, store, h)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the dump is only forgotten once everything has been delivered
+	batch.delivery.wait()
+	err = batch.changes.flush()
+	if err != nil {
+		return err
+	}
+	err = batch.clearCheckpoints()
+	if err != nil {
+		return err
+	}
+
+	duration := time.Since(start)
+	log.Printf("INFO: done processing held full dump %s. %d records (%0.2f tps)", h.File, count, float64(count)/duration.Seconds())
+	return forgetHeldDump(cfg, store, h)
+}
+
+// forget about a held dump once it has been ingested or discarded
+func forgetHeldDump(cfg ServiceConfig, store *stateStore, held heldDump) error {
+
+	err := store.releaseHeldDump(held.Source)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(held.LocalName)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return os.Remove(heldDumpFile(cfg.HoldDir, held.Source))
+}
+
+//
+// list, approve or reject held full dumps. For example:
+//
+//    virgo4-marc-ingest hold list -dir /data/held
+//    virgo4-marc-ingest hold approve -dir /data/held sirsi
+//
+// The decision is acted on by the running service.
+//
+func holdCommand(args []string) int {
+
+	if len(args) == 0 || (args[0] != "list" && args[0] != "approve" && args[0] != "reject") {
+		fmt.Fprintf(os.Stderr, "usage: %s hold list|approve|reject [options] [source...]\n", filepath.Base(os.Args[0]))
+		return 2
+	}
+
+	flags := flag.NewFlagSet("hold "+args[0], flag.ExitOnError)
+	holdDir := flags.String("dir", "", "the hold directory")
+	flags.Parse(args[1:])
+
+	if *holdDir == "" || (args[0] != "list" && flags.NArg() == 0) {
+		fmt.Fprintf(os.Stderr, "usage: %s hold %s [options] [source...]\n", filepath.Base(os.Args[0]), args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+
+	if args[0] == "list" {
+		names, err := filepath.Glob(filepath.Join(*holdDir, "*.json"))
+		if err != nil {
+			log.Printf("ERROR: %s", err.Error())
+			return 1
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			held, err := readHeldDump(*holdDir, strings.TrimSuffix(filepath.Base(name), ".json"))
+			if err != nil {
+				log.Printf("ERROR: %s cannot be read (%s)", name, err.Error())
+				return 1
+			}
+			fmt.Printf("%s: %s %s, %d records, %d bytes, held %s (%s)\n", held.Source, held.Status, held.File,
+				held.Records, held.Size, held.Held.Format(time.RFC3339), held.Reason)
+		}
+		return 0
+	}
+
+	status := holdStatusApproved
+	if args[0] == "reject" {
+		status = holdStatusRejected
+	}
+
+	for _, source := range flags.Args() {
+		held, err := readHeldDump(*holdDir, source)
+		if err != nil {
+			log.Printf("ERROR: no held full dump for %s (%s)", source, err.Error())
+			return 1
+		}
+		held.Status = status
+		err = writeHeldDump(*holdDir, held)
+		if err != nil {
+			log.Printf("ERROR: %s", err.Error())
+			return 1
+		}
+		log.Printf("INFO: full dump %s for %s %s", held.File, source, status)
+	}
+
+	return 0
+}
+
+//
+// end of file
+//
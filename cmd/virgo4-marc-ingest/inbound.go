@@ -5,6 +5,8 @@ import (
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
 	"net/url"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -12,14 +14,30 @@ type InboundFile struct {
 	SourceBucket string
 	SourceKey    string
 	ObjectSize   int64
+	ETag         string // the object ETag, if known
+	VersionId    string // the object version the event is about, blank if the bucket is not versioned
+	Sequencer    string // used to order events for the same key
 }
 
-func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHandle awssqs.QueueHandle) ([]InboundFile, awssqs.ReceiptHandle, error) {
+// the default S3 event names we ingest, objects that are removed (for example) are not
+var defaultEventNames = "ObjectCreated:*"
+
+// EventBridge events have a detail type rather than an event name, these are the S3 event name equivalents
+var eventBridgeEventNames = map[string]string{
+	"Object Created":           "ObjectCreated",
+	"Object Deleted":           "ObjectRemoved",
+	"Object Restore Initiated": "ObjectRestore",
+	"Object Restore Completed": "ObjectRestore",
+	"Object Restore Expired":   "ObjectRestore",
+}
+
+// receive up to the specified number of notifications, returns none if there are no interesting notifications
+func getInboundNotifications(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHandle awssqs.QueueHandle, sequencer *eventSequencer, count int) ([]inboundNotification, error) {
 
 	for {
 
-		// get the next message if one is available
-		messages, err := aws.BatchMessageGet(inQueueHandle, 1, time.Duration(config.PollTimeOut)*time.Second)
+		// get the next messages if any are available
+		messages, err := aws.BatchMessageGet(inQueueHandle, uint(count), time.Duration(config.PollTimeOut)*time.Second)
 		if err != nil {
 			log.Printf("ERROR: during message get (%s), sleeping and retrying", err.Error())
 
@@ -31,57 +49,151 @@ func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHan
 		}
 
 		// did we get anything to process
-		if len(messages) == 1 {
+		if len(messages) == 0 {
+			// give the caller a chance to do other work
+			log.Printf("INFO: no new notifications...")
+			return nil, nil
+		}
+
+		notifications := make([]inboundNotification, 0, len(messages))
+		for _, message := range messages {
 
 			log.Printf("INFO: received a new notification")
 
-			//log.Printf("%s", string( messages[0].Payload ) )
+			//log.Printf("%s", string( message.Payload ) )
 
-			// assume the message is an S3 event containing a list of one or more new objecxts
-			newS3objects, err := decodeS3Event(messages[0])
+			inboundFiles, err := getInboundFiles(config, message, sequencer)
 			if err != nil {
-				return nil, "", err
+				return nil, err
 			}
 
 			// we have some objects to download
-			if len(newS3objects) != 0 {
-				inboundFiles := make([]InboundFile, 0)
-				for _, s3 := range newS3objects {
-
-					// some file names may be HTML encoded... un-encode them here...
-					key, err := url.QueryUnescape(s3.S3.Object.Key)
-					if err != nil {
-						return nil, "", err
-					}
-
-					inboundFiles = append(inboundFiles,
-						InboundFile{
-							SourceBucket: s3.S3.Bucket.Name,
-							SourceKey:    key,
-							ObjectSize:   s3.S3.Object.Size})
-				}
-
-				return inboundFiles, messages[0].ReceiptHandle, nil
-			} else {
-				log.Printf("WARNING: not an interesting notification, ignoring it")
+			if len(inboundFiles) != 0 {
+				notifications = append(notifications, inboundNotification{files: inboundFiles, receiptHandle: message.ReceiptHandle})
+				continue
 			}
 
-		} else {
-			log.Printf("INFO: no new notifications...")
+			// we do not want it redelivered
+			log.Printf("WARNING: not an interesting notification, ignoring it")
+			deleteInboundMessage(aws, inQueueHandle, message.ReceiptHandle)
 		}
+
+		return notifications, nil
 	}
 }
 
+// the objects in the notification that we want to ingest
+func getInboundFiles(config ServiceConfig, message awssqs.Message, sequencer *eventSequencer) ([]InboundFile, error) {
+
+	// the message is an S3 event (possibly in an envelope) containing a list of one or more new objecxts
+	newS3objects, err := decodeS3Event(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// the objects we want to download
+	inboundFiles := make([]InboundFile, 0)
+	for _, s3 := range newS3objects {
+
+		// some file names may be HTML encoded... un-encode them here...
+		key, err := url.QueryUnescape(s3.S3.Object.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		f := InboundFile{
+			SourceBucket: s3.S3.Bucket.Name,
+			SourceKey:    key,
+			ObjectSize:   s3.S3.Object.Size,
+			ETag:         strings.Trim(s3.S3.Object.ETag, `"`),
+			VersionId:    s3.S3.Object.VersionId,
+			Sequencer:    s3.S3.Object.Sequencer,
+		}
+
+		// we are typically only interested in new objects
+		if matchesEventName(config.EventNames, s3.EventName) == false {
+			log.Printf("INFO: ignoring %s event for %s/%s", s3.EventName, f.SourceBucket, f.SourceKey)
+			continue
+		}
+
+		inboundFiles = append(inboundFiles, f)
+	}
+
+	// we may already have processed a later event for the same object
+	return sequencer.current(inboundFiles)
+}
+
 // turn a message received from the inbound queue into a list of zero or more new S3 objects
 func decodeS3Event(message awssqs.Message) ([]S3EventRecord, error) {
+	return decodeEnvelope([]byte(message.Payload))
+}
+
+// the event may be delivered directly from S3, via SNS or via EventBridge
+func decodeEnvelope(payload []byte) ([]S3EventRecord, error) {
 
-	events := Events{}
-	err := json.Unmarshal([]byte(message.Payload), &events)
+	envelope := Envelope{}
+	err := json.Unmarshal(payload, &envelope)
 	if err != nil {
 		log.Printf("ERROR: json unmarshal: %s", err)
 		return nil, err
 	}
-	return events.Records, nil
+
+	switch {
+	case len(envelope.Records) != 0:
+		return envelope.Records, nil
+
+	case envelope.Type == "Notification" && envelope.Message != "":
+		log.Printf("INFO: notification received via SNS")
+		return decodeEnvelope([]byte(envelope.Message))
+
+	case envelope.Event == "s3:TestEvent":
+		log.Printf("INFO: S3 test event received")
+
+	case envelope.Source == "aws.s3" && envelope.Detail.Bucket.Name != "":
+		log.Printf("INFO: notification received via EventBridge (%s)", envelope.DetailType)
+
+		// EventBridge object keys are not encoded in the way S3 event keys are, we encode them so they
+		// can be treated the same
+		record := S3EventRecord{}
+		record.EventName = eventBridgeEventName(envelope.DetailType, envelope.Detail.Reason)
+		record.S3.Bucket.Name = envelope.Detail.Bucket.Name
+		record.S3.Object.Key = url.QueryEscape(envelope.Detail.Object.Key)
+		record.S3.Object.Size = envelope.Detail.Object.Size
+		record.S3.Object.ETag = envelope.Detail.Object.ETag
+		record.S3.Object.VersionId = envelope.Detail.Object.VersionId
+		record.S3.Object.Sequencer = envelope.Detail.Object.Sequencer
+		return []S3EventRecord{record}, nil
+	}
+
+	return make([]S3EventRecord, 0), nil
+}
+
+// the S3 event name for an EventBridge event, for example Object Created/PutObject is ObjectCreated:PutObject
+func eventBridgeEventName(detailType string, reason string) string {
+
+	name, found := eventBridgeEventNames[detailType]
+	if found == false {
+		name = strings.ReplaceAll(detailType, " ", "")
+	}
+	if reason != "" {
+		name += ":" + reason
+	}
+	return name
+}
+
+// does the event name match any of the patterns. Events without a name are assumed to be about new objects
+func matchesEventName(patterns []string, name string) bool {
+
+	if name == "" {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched == true {
+			return true
+		}
+	}
+	return false
 }
 
 //
@@ -6,8 +6,38 @@ type Events struct {
 	Records []S3EventRecord `json:"Records"`
 }
 
+// the event may arrive in one of several envelopes, this has the fields that identify each of them
+
+type Envelope struct {
+	Records []S3EventRecord `json:"Records"` // an S3 event
+
+	Type    string `json:"Type"`    // an SNS notification, the message is the (string encoded) event
+	Message string `json:"Message"` // ...
+
+	Event string `json:"Event"` // an S3 test event, sent when the notification is configured
+
+	DetailType string            `json:"detail-type"` // an EventBridge event
+	Source     string            `json:"source"`      // ...
+	Detail     EventBridgeDetail `json:"detail"`      // ...
+}
+
+type EventBridgeDetail struct {
+	Bucket BucketRecord      `json:"bucket"`
+	Object EventBridgeObject `json:"object"`
+	Reason string            `json:"reason"`
+}
+
+type EventBridgeObject struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"etag"`
+	VersionId string `json:"version-id"`
+	Sequencer string `json:"sequencer"`
+}
+
 type S3EventRecord struct {
-	S3 S3Record `json:"S3"`
+	EventName string   `json:"eventName"`
+	S3        S3Record `json:"S3"`
 }
 
 type S3Record struct {
@@ -20,8 +50,11 @@ type BucketRecord struct {
 }
 
 type ObjectRecord struct {
-	Key  string `json:"key"`
-	Size int64  `json:"size"`
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"eTag"`
+	VersionId string `json:"versionId"`
+	Sequencer string `json:"sequencer"`
 }
 
 //
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// the size of the input buffer. The binary reader peeks at entire records (including the oversize ones Hathi
+// produces) so this must be comfortably larger than the largest record
+var inputBufferSize = 1024 * 1024
+
+// ErrNotRewindable - the input cannot be read again from the beginning
+var ErrNotRewindable = fmt.Errorf("input stream cannot be rewound")
+
+// a failure reading the underlying object or file, as opposed to a problem with its content
+type inputReadError struct {
+	err error
+}
+
+func (e *inputReadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *inputReadError) Unwrap() error {
+	return e.err
+}
+
+// is the error a failure reading the input rather than a problem with its content
+func isReadFailure(err error) bool {
+	var readErr *inputReadError
+	return errors.As(err, &readErr)
+}
+
+// marks the read failures of the underlying stream so they are not mistaken for bad content
+type failureMarkingReader struct {
+	reader io.Reader
+}
+
+func (r failureMarkingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &inputReadError{err: err}
+	}
+	return n, err
+}
+
+// a buffered input that peeks rather than seeks, so it can be read from a local file or directly
+// from a network stream
+type inputStream struct {
+	Name     string                        // for reporting
+	open     func() (io.ReadCloser, error) // opens (or reopens) the underlying stream, nil if it cannot be reopened
+	body     io.ReadCloser                 // the underlying stream
+	buffered *bufio.Reader                 // the buffered form of the above
+	offset   int64                         // the number of bytes consumed so far
+}
+
+// create an input stream, the open function is called to open the underlying stream and again if
+// we need to rewind
+func newInputStream(name string, open func() (io.ReadCloser, error)) (*inputStream, error) {
+
+	body, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &inputStream{
+		Name:     name,
+		open:     open,
+		body:     body,
+		buffered: bufio.NewReaderSize(failureMarkingReader{reader: body}, inputBufferSize),
+	}, nil
+}
+
+// create an input stream from an already open stream, it cannot be rewound once it has been read from. Used for
+// decompressed streams and archive members which pass on the read failures of the stream they are read from
+func newOneShotInputStream(name string, body io.ReadCloser) *inputStream {
+
+	return &inputStream{
+		Name:     name,
+		body:     body,
+		buffered: bufio.NewReaderSize(body, inputBufferSize),
+	}
+}
+
+// create an input stream for a local file
+func newFileInputStream(localName string) (*inputStream, error) {
+	return newInputStream(localName, func() (io.ReadCloser, error) {
+		return os.Open(localName)
+	})
+}
+
+func (s *inputStream) Read(p []byte) (int, error) {
+	n, err := s.buffered.Read(p)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *inputStream) ReadByte() (byte, error) {
+	b, err := s.buffered.ReadByte()
+	if err == nil {
+		s.offset++
+	}
+	return b, err
+}
+
+// look at the next n bytes without consuming them. If fewer are available, the error explains why
+func (s *inputStream) peek(n int) ([]byte, error) {
+	return s.buffered.Peek(n)
+}
+
+// consume the next n bytes
+func (s *inputStream) discard(n int) (int, error) {
+	discarded, err := s.buffered.Discard(n)
+	s.offset += int64(discarded)
+	return discarded, err
+}
+
+// consume everything up to and including the next occurrence of the delimiter, however far away it is
+func (s *inputStream) readThrough(delim byte) ([]byte, error) {
+	buf, err := s.buffered.ReadBytes(delim)
+	s.offset += int64(len(buf))
+	return buf, err
+}
+
+// the number of bytes consumed so far
+func (s *inputStream) position() int64 {
+	return s.offset
+}
+
+// go back to the beginning of the input. If nothing has been consumed there is nothing to do, otherwise
+// we need to reopen the underlying stream
+func (s *inputStream) rewind() error {
+
+	if s.offset == 0 {
+		return nil
+	}
+
+	if s.open == nil {
+		return ErrNotRewindable
+	}
+
+	s.body.Close()
+	body, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	s.body = body
+	s.buffered.Reset(failureMarkingReader{reader: body})
+	s.offset = 0
+	return nil
+}
+
+func (s *inputStream) close() {
+	s.body.Close()
+}
+
+//
+// end of file
+//
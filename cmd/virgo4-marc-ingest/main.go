@@ -1,12 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"time"
 
 	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
@@ -15,6 +12,35 @@ import (
 type NameTuple struct {
 	LocalName  string
 	RemoteName string
+	DataSource string // set for archive members, overrides the configured data source
+	ObjectSize int64  // the size of the inbound object the file came from
+	ETag       string // the ETag of the inbound object the file came from, used to match checkpoints
+
+	index *recordIndex // the record index built during validation (optional)
+	held  *heldDump    // set when ingesting a held full dump that has been approved
+}
+
+// the state shared by all the files from a single notification
+type ingestBatch struct {
+	duplicates *duplicateTracker // record ids across all the files
+	changes    *changeDetector   // used to skip records that have not changed (optional)
+	store      *stateStore       // the local state (optional)
+	delivery   *deliveryTracker  // confirms every record has been delivered
+
+	checkpointInterval int             // the number of records between checkpoints (0 to disable)
+	checkpoints        []*checkpointer // the checkpoints of the files being ingested
+}
+
+func newIngestBatch(cfg ServiceConfig, store *stateStore) *ingestBatch {
+
+	batch := &ingestBatch{duplicates: newDuplicateTracker(cfg), store: store, delivery: newDeliveryTracker()}
+	if store != nil {
+		batch.checkpointInterval = cfg.CheckpointInterval
+	}
+	if cfg.ChangeDetection == true {
+		batch.changes = newChangeDetector(store)
+	}
+	return batch
 }
 
 //
@@ -22,6 +48,21 @@ type NameTuple struct {
 //
 func main() {
 
+	// the validate command checks files without ingesting anything
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:]))
+	}
+
+	// the state command maintains the state store
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		os.Exit(stateCommand(os.Args[2:]))
+	}
+
+	// the hold command approves or rejects held full dumps
+	if len(os.Args) > 1 && os.Args[1] == "hold" {
+		os.Exit(holdCommand(os.Args[2:]))
+	}
+
 	log.Printf("===> %s service staring up (version: %s) <===", os.Args[0], Version())
 
 	// Get config params and use them to init service context. Any issues are fatal
@@ -35,6 +76,25 @@ func main() {
 	s3Svc, err := uva_s3.NewUvaS3(uva_s3.UvaS3Config{Logging: true})
 	fatalIfError(err)
 
+	// used when we stream objects rather than downloading them, and to download specific object versions
+	streamer, err := newS3Streamer()
+	fatalIfError(err)
+
+	// the local state, used for change detection and full dumps
+	var store *stateStore
+	if cfg.StateStore != "" {
+		store, err = openStateStore(cfg.StateStore)
+		fatalIfError(err)
+		defer store.close()
+	}
+
+	// used to ignore events that are older than ones we have already processed
+	sequencer := newEventSequencer(store)
+
+	// keeps the inbound message from being redelivered while we are busy with it
+	keeper, err := newMessageKeeper(*cfg)
+	fatalIfError(err)
+
 	// get the queue handles from the queue name
 	inQueueHandle, err := aws.QueueHandle(cfg.InQueueName)
 	fatalIfError(err)
@@ -56,156 +116,243 @@ func main() {
 		go worker(w, *cfg, aws, outQueueHandle, cacheQueueHandle, recordsChan)
 	}
 
+	// the notifications are processed concurrently, the workers are shared
+	pipelines := newIngestPipelines(*cfg, aws, s3Svc, streamer, store, sequencer, keeper, inQueueHandle, recordsChan)
+
 	for {
 		// top of our processing loop
-		err = nil
 
-		// notification that there is one or more new ingest files to be processed
-		inbound, receiptHandle, e := getInboundNotification(*cfg, aws, inQueueHandle)
+		// act on any operator decisions about held full dumps
+		e := processHeldDumps(*cfg, store, pipelines)
+		if e != nil {
+			log.Printf("ERROR: unable to process held full dumps (%s)", e.Error())
+		}
+
+		// wait for a free pipeline, we receive as many notifications as there are free pipelines
+		free := pipelines.reserve()
+
+		// notifications that there are one or more new ingest files to be processed
+		notifications, e := getInboundNotifications(*cfg, aws, inQueueHandle, sequencer, free)
 		fatalIfError(e)
+		pipelines.unreserve(free - len(notifications))
 
-		// download each file and validate it
-		fileSets := make([]NameTuple, 0)
-		for _, f := range inbound {
+		for _, n := range notifications {
+			pipelines.start(n)
+		}
+	}
+}
 
-			// save the remote name, we will need it later
-			file := NameTuple{
-				RemoteName: fmt.Sprintf("%s/%s", f.SourceBucket, f.SourceKey),
-			}
+// the record as it is published, a record we cannot transform is published unchanged
+func transformRecord(transformers []Transformer, rec Record) Record {
 
-			// VIRGONEW-2419
-			if f.ObjectSize == 0 {
-				log.Printf("INFO: notification is reporting %s is ZERO length, ignoring", file.RemoteName)
-				continue
-			}
+	transformed, err := applyTransforms(transformers, rec)
+	if err != nil {
+		id, _ := rec.Id()
+		log.Printf("ERROR: unable to transform record %s, publishing it unchanged (%s)", id, err.Error())
+		return rec
+	}
+	return transformed
+}
 
-			// create temp file
-			tmp, e := ioutil.TempFile(cfg.DownloadDir, "")
-			fatalIfError(e)
-			tmp.Close()
-			file.LocalName = tmp.Name()
-
-			// download the file
-			o := uva_s3.NewUvaS3Object(f.SourceBucket, f.SourceKey)
-			e = s3Svc.GetToFile(o, file.LocalName)
-			fatalIfError(e)
-
-			// update our lost of files to be processed
-			fileSets = append(fileSets, file)
-
-			log.Printf("INFO: validating %s (%s)", file.RemoteName, file.LocalName)
-
-			// create a new loader
-			loader, e := NewRecordLoader(cfg.DataSource, file.RemoteName, file.LocalName)
-			fatalIfError(e)
-
-			// validate the file
-			e = loader.Validate()
-			loader.Done()
-			if e == nil {
-				log.Printf("INFO: %s (%s) appears to be OK, ready for ingest", file.RemoteName, file.LocalName)
-			} else {
-				log.Printf("ERROR: %s (%s) appears to be invalid, ignoring it (%s)", file.RemoteName, file.LocalName, e.Error())
-				err = e
-				break
-			}
+// wait for every record to be delivered and then delete the inbound message
+func finishInboundMessage(aws awssqs.AWS_SQS, inQueueHandle awssqs.QueueHandle, receiptHandle awssqs.ReceiptHandle, kept *keptMessage,
+	batch *ingestBatch, sequencer *eventSequencer, inbound []InboundFile) error {
+
+	log.Printf("INFO: waiting for record delivery")
+	batch.delivery.wait()
+	kept.release()
+
+	// everything has been delivered, remember the state of the records we published
+	err := batch.changes.flush()
+	if err != nil {
+		return err
+	}
+
+	// and we will not need to resume
+	err = batch.clearCheckpoints()
+	if err != nil {
+		return err
+	}
+
+	deleteInboundMessage(aws, inQueueHandle, receiptHandle)
+	return sequencer.processed(inbound)
+}
+
+// delete the inbound message so it is not redelivered
+func deleteInboundMessage(aws awssqs.AWS_SQS, inQueueHandle awssqs.QueueHandle, receiptHandle awssqs.ReceiptHandle) {
+
+	delMessages := make([]awssqs.Message, 0, 1)
+	delMessages = append(delMessages, awssqs.Message{ReceiptHandle: receiptHandle})
+	opStatus, err := aws.BatchMessageDelete(inQueueHandle, delMessages)
+	if err != nil {
+		if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			fatalIfError(err)
 		}
+	}
 
-		// one of the files was invalid, we need to ignore the entire batch and delete the local files
-		if err != nil {
-			for _, f := range fileSets {
-				log.Printf("INFO: removing invalid file %s", f.LocalName)
-				e := os.Remove(f.LocalName)
-				fatalIfError(e)
-			}
+	// check the operation results
+	for ix, op := range opStatus {
+		if op == false {
+			log.Printf("ERROR: message %d failed to delete", ix)
+		}
+	}
+}
+
+// read all the records from the loader and publish them, returns the number of records published
+func ingestRecords(fileCfg ServiceConfig, file NameTuple, loader RecordLoader, batch *ingestBatch, records chan<- Record) (int, error) {
+
+	remoteName := file.RemoteName
+
+	// the filters and transforms configured for this data source
+	source := recordSource(fileCfg, loader)
+	sourceConfig := fileCfg.SourceConfigs.forSource(source)
+	filter := newRecordFilter(sourceConfig.Filters)
+	transformers := sourceConfig.transformers
+
+	// get the first record. An empty file is never treated as a full dump
+	count := 0
+	rec, err := loader.First(true)
+	if err != nil {
+		// are we done
+		if err == io.EOF {
+			log.Printf("WARNING: EOF on first read, unexpected empty file")
+			return count, nil
+		}
+		return count, err
+	}
 
-			// go back to waiting for the next notification
-			continue
+	// full dumps are reconciled with the previous full dump once they have been ingested, if we fail part
+	// way through we forget about this one
+	dump, err := newFullDumpReconciler(fileCfg, batch.store, source, file)
+	if err != nil {
+		return count, err
+	}
+	accepted := false
+	defer func() {
+		if accepted == false {
+			dump.abandon()
 		}
+	}()
+
+	// if we were restarted part way through this file, the records delivered before then are not published again
+	checkpoint, err := batch.checkpoint(file)
+	if err != nil {
+		return count, err
+	}
+	resumed := 0
 
-		// if we got here without an error then all the files can be processed... we can delete the inbound message
-		// because it has been processed
+	for index := 0; ; index++ {
 
-		delMessages := make([]awssqs.Message, 0, 1)
-		delMessages = append(delMessages, awssqs.Message{ReceiptHandle: receiptHandle})
-		opStatus, err := aws.BatchMessageDelete(inQueueHandle, delMessages)
+		loaded := rec
+		offset := recordOffset(rec)
+		var change *recordChange
+
+		// duplicate records may be skipped or merged with later ones
+		rec, err = batch.duplicates.resolve(remoteName, index, rec)
 		if err != nil {
-			if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
-				fatalIfError(err)
-			}
+			return count, err
 		}
 
-		// check the operation results
-		for ix, op := range opStatus {
-			if op == false {
-				log.Printf("ERROR: message %d failed to delete", ix)
-			}
+		// some records are not published at all
+		if rec != nil && filter.publish(rec) == false {
+			rec = nil
+			loaded = nil
 		}
 
-		// now we can process each of the viable inbound files
-		for _, file := range fileSets {
+		// here we overwrite the record source if configured to do so, otherwise we use the
+		// one from the loader, determined by the filename.
+		if fileCfg.DataSource != "" {
+			if rec != nil {
+				rec.SetSource(fileCfg.DataSource)
+			}
+			if loaded != nil {
+				loaded.SetSource(fileCfg.DataSource)
+			}
+		}
 
-			start := time.Now()
-			log.Printf("INFO: processing %s (%s)", file.RemoteName, file.LocalName)
+		// make any configured changes
+		var published Record
+		if rec != nil {
+			published = transformRecord(transformers, rec)
+		}
 
-			loader, err := NewRecordLoader(cfg.DataSource, file.RemoteName, file.LocalName)
-			// fatal fail here because we have already validated the file and believe it to be correct so this
-			// is some other sort of failure
-			fatalIfError(err)
+		// the remaining records (and any duplicates we skipped) are part of a full dump unless they are deleted,
+		// using the id they are published with
+		if published != nil && published.Deleted() == false {
+			err = dump.seen(published)
+		} else if rec == nil && loaded != nil {
+			err = dump.seen(transformRecord(transformers, loaded))
+		}
+		if err != nil {
+			return count, err
+		}
 
-			// get the first record
-			count := 0
-			rec, err := loader.First(true)
+		if rec != nil {
+			// records that have not changed since they were last published are not published again, the
+			// comparison is with the record before it was transformed
+			change, err = batch.changes.changed(remoteName, rec)
 			if err != nil {
-				// are we done
-				if err == io.EOF {
-					log.Printf("WARNING: EOF on first read, unexpected empty file")
-				} else {
-					// fatal fail here because we have already validated the file and believe it to be correct so this
-					// is some other sort of failure
-					log.Fatal(err)
-				}
+				return count, err
+			}
+			if change == nil {
+				rec = nil
 			}
+		}
 
-			// we can get here with an error if the first read yields EOF
-			if err == nil {
-				for {
-
-					// here we overwrite the record source if configured to do so, otherwise we use the
-					// one from the loader, determined by the filename.
-
-					if cfg.DataSource != "" {
-						rec.SetSource(cfg.DataSource)
-					}
-
-					count++
-					recordsChan <- rec
-
-					rec, err = loader.Next(true)
-					if err != nil {
-						if err == io.EOF {
-							// this is expected, break out of the processing loop
-							break
-						}
-						// fatal fail here because we have already validated the file and believe it to be correct so this
-						// is some other sort of failure
-						log.Fatal(err)
-					}
+		// the record was delivered before we restarted
+		if rec != nil && checkpoint.covers(index) == true {
+			change.confirm()
+			resumed++
+			rec = nil
+		}
+
+		if rec != nil {
+			count++
+			batch.delivery.sendFrom(records, published, change, checkpoint, index, offset)
+		}
+
+		rec, err = loader.Next(true)
+		if err != nil {
+			filter.report(remoteName)
+			if resumed != 0 {
+				log.Printf("INFO: %d records in %s were delivered before we restarted, they were not published again", resumed, remoteName)
+			}
+			if err == io.EOF {
+				// this is expected, break out of the processing loop
+				deleted, err := dump.finish(batch, records)
+				if err != nil {
+					return count, err
 				}
+				accepted = true
+				return count + deleted, nil
 			}
+			return count, err
+		}
 
-			loader.Done()
-			duration := time.Since(start)
-			log.Printf("INFO: done processing %s (%s). %d records (%0.2f tps)", file.RemoteName, file.LocalName, count, float64(count)/duration.Seconds())
-
-			// file has been ingested, remove it
-			log.Printf("INFO: removing processed file %s", file.LocalName)
-			err = os.Remove(file.LocalName)
-			fatalIfError(err)
+		// when quarantining, we stop as soon as there are too many bad records rather than publishing the rest
+		if fileCfg.ErrorPolicy == errorPolicyQuarantine && len(loader.BadRecords()) > fileCfg.BadRecordThreshold {
+			log.Printf("ERROR: %s has more than %d bad records, stopping", remoteName, fileCfg.BadRecordThreshold)
+			return count, ErrTooManyBadRecords
 		}
 	}
 }
 
+// the data source of the records in a file
+func recordSource(fileCfg ServiceConfig, loader RecordLoader) string {
+	if fileCfg.DataSource != "" {
+		return fileCfg.DataSource
+	}
+	return loader.Source()
+}
+
+// the configuration to use for a specific file, archive members can have their own data source
+func fileConfig(cfg ServiceConfig, file NameTuple) ServiceConfig {
+	if file.DataSource != "" {
+		cfg.DataSource = file.DataSource
+	}
+	return cfg
+}
+
 //
 // end of file
 //
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//
+// MARC-8 to UTF-8 conversion, see https://www.loc.gov/marc/specifications/speccharmarc8.html
+//
+// The commonly used character sets (ASCII, ANSEL, Greek symbols, subscripts, superscripts and basic Cyrillic) are
+// built in. The remaining sets, including EACC (CJK), are loaded from the Library of Congress code table file
+// (https://www.loc.gov/marc/specifications/codetables.xml) when one is configured.
+//
+
+// the escape character that introduces a character set change
+var marc8Escape = byte(0x1b)
+
+// character set final characters
+var marc8BasicLatin = byte(0x42)
+var marc8Ansel = byte(0x45)
+var marc8GreekSymbols = byte(0x67)
+var marc8Subscript = byte(0x62)
+var marc8Superscript = byte(0x70)
+var marc8BasicCyrillic = byte(0x4e)
+var marc8Eacc = byte(0x31)
+
+// ErrNoMarc8CharacterSets - the code table file did not contain any character sets we can use
+var ErrNoMarc8CharacterSets = fmt.Errorf("no MARC-8 character sets found in code tables")
+
+// the replacement for characters we cannot convert
+var marc8Replacement = '\uFFFD'
+
+// a MARC-8 character
+type marc8Char struct {
+	r         rune // the unicode equivalent
+	combining bool // is this a combining character
+}
+
+// a MARC-8 character set, characters are keyed by their 7 bit code(s)
+type marc8Set struct {
+	multibyte bool
+	chars     map[uint32]marc8Char
+}
+
+// the MARC-8 transcoder
+type marc8Transcoder struct {
+	sets map[byte]*marc8Set // keyed by the set final character
+}
+
+// we only want to load the code tables once
+var marc8Once sync.Once
+var marc8Shared *marc8Transcoder
+var marc8SharedErr error
+
+// get the shared transcoder, loading the code tables on first use
+func getMarc8Transcoder(codeTableFile string) (*marc8Transcoder, error) {
+	marc8Once.Do(func() {
+		marc8Shared, marc8SharedErr = newMarc8Transcoder(codeTableFile)
+	})
+	return marc8Shared, marc8SharedErr
+}
+
+func newMarc8Transcoder(codeTableFile string) (*marc8Transcoder, error) {
+
+	t := &marc8Transcoder{sets: make(map[byte]*marc8Set)}
+	t.sets[marc8BasicLatin] = makeBasicLatinSet()
+	t.sets[marc8Ansel] = makeSingleByteSet(anselChars, anselCombining)
+	t.sets[marc8GreekSymbols] = makeSingleByteSet(greekSymbolChars, nil)
+	t.sets[marc8Subscript] = makeSingleByteSet(subscriptChars, nil)
+	t.sets[marc8Superscript] = makeSingleByteSet(superscriptChars, nil)
+	t.sets[marc8BasicCyrillic] = makeSingleByteSet(basicCyrillicChars, nil)
+
+	if codeTableFile != "" {
+		err := t.loadCodeTables(codeTableFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, found := t.sets[marc8Eacc]; found == false {
+		log.Printf("WARNING: MARC-8 EACC character set not available, CJK characters will not be converted")
+	}
+
+	return t, nil
+}
+
+// convert a MARC-8 string to UTF-8, returns the converted string and the number of characters that could not be converted
+func (t *marc8Transcoder) transcode(value string) (string, int) {
+
+	// nothing to do for plain ASCII
+	if isPlainAscii(value) {
+		return value, 0
+	}
+
+	g0 := marc8BasicLatin
+	g1 := marc8Ansel
+	unmapped := 0
+
+	var out strings.Builder
+	combining := make([]rune, 0)
+
+	// combining characters precede the base character in MARC-8 and follow it in unicode
+	emit := func(r rune) {
+		out.WriteRune(r)
+		for _, c := range combining {
+			out.WriteRune(c)
+		}
+		combining = combining[:0]
+	}
+
+	for ix := 0; ix < len(value); {
+		c := value[ix]
+
+		if c == marc8Escape {
+			consumed, set, graphic1, ok := parseMarc8Escape(value[ix:])
+			if ok == false {
+				unmapped++
+				ix++
+				continue
+			}
+			if graphic1 == true {
+				g1 = set
+			} else {
+				g0 = set
+			}
+			ix += consumed
+			continue
+		}
+
+		// a subfield delimiter and the subfield code after it are the same in every set, the current sets carry
+		// on into the next subfield
+		if c == subfieldDelimiter {
+			for _, r := range combining {
+				out.WriteRune(r)
+			}
+			combining = combining[:0]
+			end := ix + 2
+			if end > len(value) {
+				end = len(value)
+			}
+			out.WriteString(value[ix:end])
+			ix = end
+			continue
+		}
+
+		// controls and space are the same in every set
+		if c <= 0x20 || c == 0x7f {
+			emit(rune(c))
+			ix++
+			continue
+		}
+
+		// a few special cases in the C1 range
+		if c >= 0x80 && c <= 0xa0 {
+			switch c {
+			case 0x88:
+				emit('\u0098') // non-sort begin
+			case 0x89:
+				emit('\u009C') // non-sort end
+			case 0x8d:
+				emit('\u200D') // zero width joiner
+			case 0x8e:
+				emit('\u200C') // zero width non-joiner
+			default:
+				unmapped++
+			}
+			ix++
+			continue
+		}
+
+		setId := g0
+		if c >= 0x80 {
+			setId = g1
+		}
+
+		// EACC is multibyte even if we do not have it
+		set, found := t.sets[setId]
+		width := 1
+		if (found == true && set.multibyte == true) || setId == marc8Eacc {
+			width = 3
+		}
+		if ix+width > len(value) {
+			unmapped++
+			break
+		}
+
+		code := uint32(0)
+		for _, b := range []byte(value[ix : ix+width]) {
+			code = code<<8 | uint32(b&0x7f)
+		}
+		ix += width
+
+		var ch marc8Char
+		if found == true {
+			ch, found = set.chars[code]
+		}
+		if found == false {
+			unmapped++
+			emit(marc8Replacement)
+			continue
+		}
+
+		if ch.combining == true {
+			combining = append(combining, ch.r)
+		} else {
+			emit(ch.r)
+		}
+	}
+
+	// any trailing combining characters
+	for _, c := range combining {
+		out.WriteRune(c)
+	}
+
+	return out.String(), unmapped
+}
+
+// convert a MARC-8 record to UTF-8. The leader character coding scheme is updated and the record length and
+// directory are recalculated. The subfields of each field are converted together because an escape sequence
+// applies until the end of the field, not just to the subfield it appears in
+func (t *marc8Transcoder) transcodeRecord(rec Record) (Record, error) {
+
+	id, _ := rec.Id()
+	leader := []byte(rec.Leader())
+	if len(leader) != marcRecordLeaderSize {
+		log.Printf("ERROR: cannot transcode marc record %s, leader is invalid", id)
+		return nil, ErrBadRecord
+	}
+	leader[9] = 'a'
+
+	unmapped := 0
+	parsed := &marcRecord{leader: string(leader)}
+	for _, f := range rec.Fields("") {
+		field := MarcField{Tag: f.Tag, Control: f.IsControl(), Indicator1: f.Indicator1, Indicator2: f.Indicator2}
+		if f.IsControl() {
+			value, count := t.transcode(f.Value)
+			field.Value = value
+			unmapped += count
+		} else {
+			var data strings.Builder
+			for _, sf := range f.Subfields {
+				data.WriteByte(subfieldDelimiter)
+				data.WriteString(sf.Code)
+				data.WriteString(sf.Value)
+			}
+			value, count := t.transcode(data.String())
+			unmapped += count
+
+			field.Subfields = make([]MarcSubfield, 0, len(f.Subfields))
+			for _, sf := range strings.Split(value, string(subfieldDelimiter)) {
+				if len(sf) == 0 {
+					continue
+				}
+				field.Subfields = append(field.Subfields, MarcSubfield{Code: sf[0:1], Value: sf[1:]})
+			}
+		}
+		parsed.fields = append(parsed.fields, field)
+	}
+
+	if unmapped != 0 {
+		log.Printf("WARNING: %d character(s) in marc record %s could not be converted from MARC-8", unmapped, id)
+	}
+
+	converted, err := newRecordFromParsed(parsed, rec.Source(), rec.Format())
+	if err != nil {
+		log.Printf("ERROR: cannot transcode marc record %s (%s)", id, err.Error())
+		return nil, err
+	}
+	return converted, nil
+}
+
+// parse an escape sequence, returns the number of bytes consumed, the selected set and if it applies to the G1 set
+func parseMarc8Escape(value string) (int, byte, bool, bool) {
+
+	if len(value) < 2 {
+		return 0, 0, false, false
+	}
+
+	// technique 1, greek symbols, subscripts, superscripts and the return to ASCII
+	switch value[1] {
+	case marc8GreekSymbols, marc8Subscript, marc8Superscript:
+		return 2, value[1], false, true
+	case 's':
+		return 2, marc8BasicLatin, false, true
+	}
+
+	// technique 2, optional multibyte indicator, intermediate character(s) then the final character
+	ix := 1
+	if value[ix] == '$' {
+		ix++
+	}
+	if ix >= len(value) {
+		return 0, 0, false, false
+	}
+
+	graphic1 := false
+	switch value[ix] {
+	case '(', ',':
+		ix++
+	case ')', '-':
+		graphic1 = true
+		ix++
+	default:
+		// the multibyte form may omit the intermediate for G0
+		if ix == 1 {
+			return 0, 0, false, false
+		}
+	}
+
+	// the ANSEL set has a 2 character final
+	if ix < len(value) && value[ix] == '!' {
+		ix++
+	}
+	if ix >= len(value) {
+		return 0, 0, false, false
+	}
+
+	return ix + 1, value[ix], graphic1, true
+}
+
+func isPlainAscii(value string) bool {
+	for ix := 0; ix < len(value); ix++ {
+		if value[ix] >= 0x80 || value[ix] == marc8Escape {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// code table file support
+//
+
+// this describes the structure of the Library of Congress code table file. Each code table contains one or more
+// character sets, identified by the final character of their escape sequence (ISOcode)
+type marc8CodeTables struct {
+	Tables []marc8CodeTable `xml:"codeTable"`
+}
+
+type marc8CodeTable struct {
+	Name string              `xml:"name,attr"`
+	Sets []marc8CharacterSet `xml:"characterSet"`
+}
+
+type marc8CharacterSet struct {
+	Name    string      `xml:"name,attr"`
+	IsoCode string      `xml:"ISOcode,attr"`
+	Codes   []marc8Code `xml:"code"`
+}
+
+type marc8Code struct {
+	Marc        string `xml:"marc"`
+	Ucs         string `xml:"ucs"`
+	Alt         string `xml:"alt"`
+	IsCombining string `xml:"isCombining"`
+}
+
+func (t *marc8Transcoder) loadCodeTables(codeTableFile string) error {
+
+	file, err := os.Open(codeTableFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tables := marc8CodeTables{}
+	err = xml.NewDecoder(file).Decode(&tables)
+	if err != nil {
+		log.Printf("ERROR: unable to decode MARC-8 code tables %s (%s)", codeTableFile, err.Error())
+		return err
+	}
+
+	loaded := 0
+	for _, table := range tables.Tables {
+		for _, charSet := range table.Sets {
+
+			final, err := hex.DecodeString(charSet.IsoCode)
+			if err != nil || len(final) != 1 {
+				log.Printf("WARNING: ignoring MARC-8 character set %s, cannot determine final character (%s)", charSet.Name, charSet.IsoCode)
+				continue
+			}
+
+			// the characters are added to any built in set with the same final character
+			set, found := t.sets[final[0]]
+			if found == false {
+				set = &marc8Set{chars: make(map[uint32]marc8Char)}
+			}
+			count := 0
+			for _, code := range charSet.Codes {
+				marc, err := hex.DecodeString(code.Marc)
+				if err != nil || len(marc) == 0 {
+					continue
+				}
+				ucs := code.Ucs
+				if ucs == "" {
+					ucs = code.Alt
+				}
+				r, err := strconv.ParseUint(ucs, 16, 32)
+				if err != nil || utf8.ValidRune(rune(r)) == false {
+					continue
+				}
+
+				key := uint32(0)
+				for _, b := range marc {
+					key = key<<8 | uint32(b&0x7f)
+				}
+				if len(marc) > 1 {
+					set.multibyte = true
+				}
+				set.chars[key] = marc8Char{r: rune(r), combining: code.IsCombining == "true"}
+				count++
+			}
+
+			if count == 0 {
+				log.Printf("WARNING: ignoring MARC-8 character set %s, it has no usable characters", charSet.Name)
+				continue
+			}
+
+			t.sets[final[0]] = set
+			loaded++
+			log.Printf("INFO: loaded MARC-8 character set %s (%d characters)", charSet.Name, count)
+		}
+	}
+
+	if loaded == 0 {
+		log.Printf("ERROR: MARC-8 code tables %s contain no usable character sets", codeTableFile)
+		return ErrNoMarc8CharacterSets
+	}
+
+	return nil
+}
+
+//
+// built in character sets
+//
+
+func makeBasicLatinSet() *marc8Set {
+	set := &marc8Set{chars: make(map[uint32]marc8Char)}
+	for c := uint32(0x21); c <= 0x7e; c++ {
+		set.chars[c] = marc8Char{r: rune(c)}
+	}
+	return set
+}
+
+func makeSingleByteSet(chars map[byte]rune, combining map[byte]rune) *marc8Set {
+	set := &marc8Set{chars: make(map[uint32]marc8Char)}
+	for c, r := range chars {
+		set.chars[uint32(c&0x7f)] = marc8Char{r: r}
+	}
+	for c, r := range combining {
+		set.chars[uint32(c&0x7f)] = marc8Char{r: r, combining: true}
+	}
+	return set
+}
+
+// extended Latin (ANSEL) spacing characters
+var anselChars = map[byte]rune{
+	0xa1: 'Ł', // latin capital letter L with stroke
+	0xa2: 'Ø', // latin capital letter O with stroke
+	0xa3: 'Đ', // latin capital letter D with stroke
+	0xa4: 'Þ', // latin capital letter thorn
+	0xa5: 'Æ', // latin capital letter AE
+	0xa6: 'Œ', // latin capital ligature OE
+	0xa7: 'ʹ', // modifier letter prime
+	0xa8: '·', // middle dot
+	0xa9: '♭', // music flat sign
+	0xaa: '®', // registered sign
+	0xab: '±', // plus-minus sign
+	0xac: 'Ơ', // latin capital letter O with horn
+	0xad: 'Ư', // latin capital letter U with horn
+	0xae: 'ʼ', // modifier letter apostrophe
+	0xb0: 'ʻ', // modifier letter turned comma
+	0xb1: 'ł', // latin small letter l with stroke
+	0xb2: 'ø', // latin small letter o with stroke
+	0xb3: 'đ', // latin small letter d with stroke
+	0xb4: 'þ', // latin small letter thorn
+	0xb5: 'æ', // latin small letter ae
+	0xb6: 'œ', // latin small ligature oe
+	0xb7: 'ʺ', // modifier letter double prime
+	0xb8: 'ı', // latin small letter dotless i
+	0xb9: '£', // pound sign
+	0xba: 'ð', // latin small letter eth
+	0xbc: 'ơ', // latin small letter o with horn
+	0xbd: 'ư', // latin small letter u with horn
+	0xc0: '°', // degree sign
+	0xc1: 'ℓ', // script small l
+	0xc2: '℗', // sound recording copyright
+	0xc3: '©', // copyright sign
+	0xc4: '♯', // music sharp sign
+	0xc5: '¿', // inverted question mark
+	0xc6: '¡', // inverted exclamation mark
+	0xc7: 'ß', // latin small letter sharp s
+	0xc8: '€', // euro sign
+}
+
+// extended Latin (ANSEL) combining diacritics
+var anselCombining = map[byte]rune{
+	0xe0: '\u0309', // combining hook above
+	0xe1: '\u0300', // combining grave accent
+	0xe2: '\u0301', // combining acute accent
+	0xe3: '\u0302', // combining circumflex accent
+	0xe4: '\u0303', // combining tilde
+	0xe5: '\u0304', // combining macron
+	0xe6: '\u0306', // combining breve
+	0xe7: '\u0307', // combining dot above
+	0xe8: '\u0308', // combining diaeresis
+	0xe9: '\u030C', // combining caron
+	0xea: '\u030A', // combining ring above
+	0xeb: '\uFE20', // combining ligature left half
+	0xec: '\uFE21', // combining ligature right half
+	0xed: '\u0315', // combining comma above right
+	0xee: '\u030B', // combining double acute accent
+	0xef: '\u0310', // combining candrabindu
+	0xf0: '\u0327', // combining cedilla
+	0xf1: '\u0328', // combining ogonek
+	0xf2: '\u0323', // combining dot below
+	0xf3: '\u0324', // combining diaeresis below
+	0xf4: '\u0325', // combining ring below
+	0xf5: '\u0333', // combining double low line
+	0xf6: '\u0332', // combining low line
+	0xf7: '\u0326', // combining comma below
+	0xf8: '\u031C', // combining left half ring below
+	0xf9: '\u032E', // combining breve below
+	0xfa: '\uFE22', // combining double tilde left half
+	0xfb: '\uFE23', // combining double tilde right half
+	0xfe: '\u0313', // combining comma above
+}
+
+var greekSymbolChars = map[byte]rune{
+	0x61: 'α', // greek small letter alpha
+	0x62: 'β', // greek small letter beta
+	0x63: 'γ', // greek small letter gamma
+}
+
+var subscriptChars = map[byte]rune{
+	0x28: '₍', 0x29: '₎', 0x2b: '₊', 0x2d: '₋',
+	0x30: '₀', 0x31: '₁', 0x32: '₂', 0x33: '₃', 0x34: '₄',
+	0x35: '₅', 0x36: '₆', 0x37: '₇', 0x38: '₈', 0x39: '₉',
+}
+
+var superscriptChars = map[byte]rune{
+	0x28: '⁽', 0x29: '⁾', 0x2b: '⁺', 0x2d: '⁻',
+	0x30: '⁰', 0x31: '¹', 0x32: '²', 0x33: '³', 0x34: '⁴',
+	0x35: '⁵', 0x36: '⁶', 0x37: '⁷', 0x38: '⁸', 0x39: '⁹',
+}
+
+// basic Cyrillic, punctuation and digits are the same as ASCII
+var basicCyrillicChars = map[byte]rune{
+	0x21: '!', 0x22: '"', 0x23: '#', 0x24: '$', 0x25: '%', 0x26: '&', 0x27: '\'', 0x28: '(',
+	0x29: ')', 0x2a: '*', 0x2b: '+', 0x2c: ',', 0x2d: '-', 0x2e: '.', 0x2f: '/', 0x30: '0',
+	0x31: '1', 0x32: '2', 0x33: '3', 0x34: '4', 0x35: '5', 0x36: '6', 0x37: '7', 0x38: '8',
+	0x39: '9', 0x3a: ':', 0x3b: ';', 0x3c: '<', 0x3d: '=', 0x3e: '>', 0x3f: '?',
+	0x40: 'ю', 0x41: 'а', 0x42: 'б', 0x43: 'ц', 0x44: 'д', 0x45: 'е',
+	0x46: 'ф', 0x47: 'г', 0x48: 'х', 0x49: 'и', 0x4a: 'й', 0x4b: 'к',
+	0x4c: 'л', 0x4d: 'м', 0x4e: 'н', 0x4f: 'о', 0x50: 'п', 0x51: 'я',
+	0x52: 'р', 0x53: 'с', 0x54: 'т', 0x55: 'у', 0x56: 'ж', 0x57: 'в',
+	0x58: 'ь', 0x59: 'ы', 0x5a: 'з', 0x5b: 'ш', 0x5c: 'э', 0x5d: 'щ',
+	0x5e: 'ч', 0x5f: 'ъ',
+	0x60: 'Ю', 0x61: 'А', 0x62: 'Б', 0x63: 'Ц', 0x64: 'Д', 0x65: 'Е',
+	0x66: 'Ф', 0x67: 'Г', 0x68: 'Х', 0x69: 'И', 0x6a: 'Й', 0x6b: 'К',
+	0x6c: 'Л', 0x6d: 'М', 0x6e: 'Н', 0x6f: 'О', 0x70: 'П', 0x71: 'Я',
+	0x72: 'Р', 0x73: 'С', 0x74: 'Т', 0x75: 'У', 0x76: 'Ж', 0x77: 'В',
+	0x78: 'Ь', 0x79: 'Ы', 0x7a: 'З', 0x7b: 'Ш', 0x7c: 'Э', 0x7d: 'Щ',
+	0x7e: 'Ч',
+}
+
+//
+// end of file
+//
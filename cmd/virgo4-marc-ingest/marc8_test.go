@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// the code table file, an excerpt of the Library of Congress file unless MARC8_CODETABLES names the complete one
+func testCodeTableFile() string {
+	if name := os.Getenv("MARC8_CODETABLES"); name != "" {
+		return name
+	}
+	return "testdata/codetables.xml"
+}
+
+func TestMarc8LoadCodeTables(t *testing.T) {
+
+	transcoder, err := newMarc8Transcoder(testCodeTableFile())
+	if err != nil {
+		t.Fatalf("unable to load code tables (%s)", err.Error())
+	}
+
+	// the character sets are identified by the characterSet ISOcode
+	for _, final := range []byte{marc8BasicLatin, marc8Ansel, marc8Eacc, '2'} {
+		if _, found := transcoder.sets[final]; found == false {
+			t.Errorf("character set %c not loaded", final)
+		}
+	}
+	if transcoder.sets[marc8Eacc].multibyte == false {
+		t.Errorf("EACC character set is not multibyte")
+	}
+	if transcoder.sets[marc8Ansel].chars[0xe2&0x7f].combining == false {
+		t.Errorf("ANSEL acute is not combining")
+	}
+}
+
+func TestMarc8Transcode(t *testing.T) {
+
+	transcoder, err := newMarc8Transcoder(testCodeTableFile())
+	if err != nil {
+		t.Fatalf("unable to load code tables (%s)", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		marc8    string
+		expected string
+	}{
+		{"ANSEL acute", "Caf\xe2e", "Cafe\u0301"},
+		{"ANSEL stacked diacritics", "\xe4\xe2a", "a\u0303\u0301"},
+		{"ANSEL spacing characters", "\xc3 \xa2\xb5", "© Øæ"},
+		{"EACC in G0", "\x1b$1\x21\x30\x21\x1b(B.", "一."},
+		{"EACC in G1", "a\x1b$)1\xa1\xb0\xa1", "a一"},
+		{"Hebrew", "\x1b(2\x60\x61\x1b(B", "אב"},
+		{"escape spans subfields", "\x1fa\x1b(2\x60\x1fb\x61\x1b(B", "\x1faא\x1fbב"},
+		{"EACC spans subfields", "\x1fa\x1b$1\x21\x30\x21\x1fb\x21\x30\x21", "\x1fa一\x1fb一"},
+	}
+
+	for _, test := range tests {
+		converted, unmapped := transcoder.transcode(test.marc8)
+		if unmapped != 0 {
+			t.Errorf("%s: %d characters not converted", test.name, unmapped)
+		}
+		if converted != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, converted)
+		}
+	}
+}
+
+func TestMarc8NoCharacterSets(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "codetables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	// the structure before the character sets were nested within the code tables
+	file.WriteString(`<codeTables><codeTable name="Extended Latin (ANSEL)" marcLeft="45"><code><marc>E2</marc><ucs>0301</ucs></code></codeTable></codeTables>`)
+	file.Close()
+
+	_, err = newMarc8Transcoder(file.Name())
+	if err != ErrNoMarc8CharacterSets {
+		t.Errorf("expected %v, got %v", ErrNoMarc8CharacterSets, err)
+	}
+}
+
+//
+// end of file
+//
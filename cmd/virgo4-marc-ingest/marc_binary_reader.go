@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+)
+
+//
+// This implementation based on the MARC reader code here:
+//
+// https://github.com/marc4j/marc4j/blob/master/src/org/marc4j/util/RawRecord.java
+// https://github.com/marc4j/marc4j/blob/master/src/org/marc4j/util/RawRecordReader.java
+//
+// All errors in the implementation are mine :)
+//
+
+// reads ISO 2709 (binary) MARC records
+type marcBinaryReader struct {
+	DataSource string       // determined from the filename
+	Input      *inputStream // our input stream
+	Recover    bool         // skip corrupt records rather than failing
+	skipped    []BadRecord  // the corrupt records we have skipped
+}
+
+// the size of the window used when scanning forward for the next record
+var resyncBufferSize = 64 * 1024
+
+func newMarcBinaryReader(input *inputStream, source string, recover bool) recordReader {
+	return &marcBinaryReader{Input: input, DataSource: source, Recover: recover}
+}
+
+func (r *marcBinaryReader) rewind() error {
+	r.skipped = nil
+	return r.Input.rewind()
+}
+
+func (r *marcBinaryReader) read() (Record, error) {
+
+	for {
+		start := r.Input.position()
+		rec, err := r.rawMarcRead()
+		if err == nil {
+			rec.(*recordImpl).offset = start
+			return rec, nil
+		}
+		if r.Recover == false || isReadFailure(err) == true {
+			return nil, err
+		}
+
+		// a clean end of file is not a corrupt record
+		if err == io.EOF {
+			if r.truncated() == false {
+				return nil, err
+			}
+			err = badRecordError("record truncated at end of file")
+		}
+
+		// scan forward for the next thing that looks like a record and carry on from there
+		raw, resyncErr := r.resync()
+		next := r.Input.position()
+
+		bad := BadRecord{Offset: start, Length: next - start, Reason: err.Error(), Raw: raw}
+		r.skipped = append(r.skipped, bad)
+
+		if resyncErr != nil {
+			log.Printf("WARNING: skipped %d bytes of bad data at offset %d, no further records located (%s)", bad.Length, start, bad.Reason)
+			return nil, resyncErr
+		}
+		log.Printf("WARNING: skipped %d bytes of bad data at offset %d, resuming at offset %d (%s)", bad.Length, start, next, bad.Reason)
+	}
+}
+
+func (r *marcBinaryReader) badRecords() []BadRecord {
+	return r.skipped
+}
+
+func (r *marcBinaryReader) close() {
+	r.Input.close()
+}
+
+//
+// the record is located by peeking at the input, nothing is consumed unless we locate a record so, if
+// we fail, the input is still positioned at the start of the bad data
+//
+
+func (r *marcBinaryReader) rawMarcRead() (Record, error) {
+
+	// the 5 byte length header
+	header, err := r.Input.peek(marcRecordHeaderSize)
+	if err != nil {
+		if len(header) == 0 || err != io.EOF {
+			return nil, err
+		}
+		log.Printf("WARNING: short record header read. Expected %d, got %d. Declaring EOF", marcRecordHeaderSize, len(header))
+		return nil, io.EOF
+	}
+
+	// is it potentially a record length?
+	length, err := strconv.Atoi(string(header))
+	if err != nil {
+		if r.Recover == true {
+			return nil, badRecordError(fmt.Sprintf("marc record prefix is not a length (%s)", string(header)))
+		}
+		return nil, err
+	}
+
+	// ensure the number is sane
+	if length <= marcRecordHeaderSize {
+		log.Printf("ERROR: marc record prefix invalid (%s)", string(header))
+		return nil, badRecordError(fmt.Sprintf("marc record prefix invalid (%s)", string(header)))
+	}
+
+	// the header is included in the raw record
+	readBuf, err := r.Input.peek(length)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// we did not get the number of bytes we expected, log it and declare victory
+	if len(readBuf) != length {
+		log.Printf("WARNING: short record read. Expected %d, got %d. Declaring EOF", length, len(readBuf))
+		return nil, io.EOF
+	}
+
+	// verify the end of record marker exists and return success if it does
+	if readBuf[length-2] == fieldTerminator && readBuf[length-1] == recordTerminator {
+		return r.consume(length)
+	}
+
+	log.Printf("WARNING: unexpected marc record suffix. Expected (%x %x) got (%x %x). Header length reports %d", fieldTerminator, recordTerminator, readBuf[length-2], readBuf[length-1], length)
+
+	//
+	// we have a badly formed record, look to see if the terminator appears earlier in the record (in bytes we have already read)
+	//
+
+	tag := []byte{fieldTerminator, recordTerminator}
+	foundIx := bytes.Index(readBuf, tag)
+	if foundIx != -1 {
+		log.Printf("WARNING: located record terminator earlier in the buffer at offset %d", foundIx)
+
+		// the next record begins immediately after the terminator
+		return r.consume(foundIx + len(tag))
+	}
+
+	//
+	// we did not find the record terminator in the buffer we have already read,
+	// now look to see if it appears later (because this is a record larger than 5 digits)
+	// hate how Hathi does this, should probably follow the Sirsi model instead
+	//
+
+	additionalBuffer, err := r.Input.peek(inputBufferSize)
+	if err != nil && err != io.EOF {
+		log.Printf("ERROR: reading forward for record terminator, giving up (%s)", err.Error())
+	}
+
+	if len(additionalBuffer) > length {
+		foundIx = bytes.IndexByte(additionalBuffer[length:], recordTerminator)
+		if foundIx != -1 {
+			log.Printf("WARNING: record terminator located after an additional %d bytes", foundIx+1)
+			return r.consume(length + foundIx + 1)
+		}
+	}
+
+	// the terminator is further away than we can peek, read forward until we find it. The input is no longer
+	// positioned at the start of the bad data if we do not
+	if len(additionalBuffer) == inputBufferSize {
+		raw, err := r.Input.readThrough(recordTerminator)
+		if err == nil {
+			log.Printf("WARNING: record terminator located after an additional %d bytes", len(raw)-length)
+			return &recordImpl{RawBytes: raw, source: r.DataSource, format: recordFormatMarc}, nil
+		}
+		if err != io.EOF {
+			log.Printf("ERROR: reading forward for record terminator, giving up (%s)", err.Error())
+			return nil, err
+		}
+	}
+
+	//log.Printf("FIXME: %s", string(readBuf))
+	return nil, badRecordError("cannot locate record terminator")
+}
+
+// consume the next record from the input
+func (r *marcBinaryReader) consume(length int) (Record, error) {
+
+	raw := make([]byte, length)
+	_, err := io.ReadFull(r.Input, raw)
+	if err != nil {
+		return nil, err
+	}
+	return &recordImpl{RawBytes: raw, source: r.DataSource, format: recordFormatMarc}, nil
+}
+
+// was the last read a truncated record rather than a clean end of file
+func (r *marcBinaryReader) truncated() bool {
+	remaining, _ := r.Input.peek(1)
+	return len(remaining) != 0
+}
+
+// skip the bad data at the current position by scanning forward for something that looks like the start
+// of a record and positioning the input there. Returns the skipped bytes (capped at the largest possible
+// record) and io.EOF if there is nothing that looks like a record.
+func (r *marcBinaryReader) resync() ([]byte, error) {
+
+	skipped := make([]byte, 0)
+	skip := func(n int) error {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r.Input, buf)
+		if len(skipped) < marcRecordMaxLength {
+			if len(skipped)+n > marcRecordMaxLength {
+				buf = buf[:marcRecordMaxLength-len(skipped)]
+			}
+			skipped = append(skipped, buf...)
+		}
+		return err
+	}
+
+	// the current position is bad so we always move past it
+	err := skip(1)
+	if err != nil {
+		return skipped, io.EOF
+	}
+
+	for {
+		buf, err := r.Input.peek(resyncBufferSize)
+		for ix := 0; ix+marcRecordLeaderSize <= len(buf); ix++ {
+			if isPlausibleLeader(buf[ix : ix+marcRecordLeaderSize]) {
+				return skipped, skip(ix)
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				skip(len(buf))
+			}
+			return skipped, err
+		}
+
+		// keep the tail of the buffer, it may contain the beginning of a leader
+		err = skip(len(buf) - (marcRecordLeaderSize - 1))
+		if err != nil {
+			return skipped, err
+		}
+	}
+}
+
+// does this look like a MARC leader; numeric record length and base address and the standard indicator
+// count and subfield code length
+func isPlausibleLeader(leader []byte) bool {
+
+	if len(leader) < marcRecordLeaderSize {
+		return false
+	}
+	for _, ix := range []int{0, 1, 2, 3, 4, 12, 13, 14, 15, 16} {
+		if leader[ix] < '0' || leader[ix] > '9' {
+			return false
+		}
+	}
+	return leader[10] == '2' && leader[11] == '2'
+}
+
+//
+// end of file
+//
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// what we do with duplicate control fields when merging records
+var mergeControlFirst = "first" // keep the control field from the first record
+var mergeControlLast = "last"   // keep the control field from the last record
+
+// what we do when a merged record is too large to be represented in ISO 2709
+var oversizeReject = "reject"     // the record is treated as a bad record
+var oversizeFirst = "first"       // the continuation records are discarded
+var oversizeTruncate = "truncate" // continuation fields are discarded from the end until the record fits
+
+//
+// merge a continuation record (one with the same id as the previous record) into the previous record. The result
+// is a single valid record with the fields of both. The fields of the first record keep their order, the control
+// fields of the continuation record follow those of the first record and its data fields are added at the end.
+// The leader comes from the first record and the length and base address are recalculated.
+//
+func mergeRecords(config ServiceConfig, first Record, next Record) (Record, error) {
+
+	firstImpl := first.(*recordImpl)
+	firstParsed, err := firstImpl.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	nextParsed, err := next.(*recordImpl).parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// the control fields of the next record either replace or are replaced by those of the first
+	nextControl := make(map[string]bool)
+	for _, f := range nextParsed.fields {
+		if f.IsControl() == true {
+			nextControl[f.Tag] = true
+		}
+	}
+	firstControl := make(map[string]bool)
+	firstFields := make([]MarcField, 0, len(firstParsed.fields))
+	insertAt := 0
+	for _, f := range firstParsed.fields {
+		if f.IsControl() == true {
+			firstControl[f.Tag] = true
+			if config.MergeControlPolicy == mergeControlLast && nextControl[f.Tag] == true {
+				continue
+			}
+		}
+		firstFields = append(firstFields, f)
+		if f.IsControl() == true {
+			insertAt = len(firstFields)
+		}
+	}
+
+	// the fields added by the continuation record, control fields first
+	added := make([]MarcField, 0, len(nextParsed.fields))
+	for _, f := range nextParsed.fields {
+		if f.IsControl() == true && (config.MergeControlPolicy == mergeControlLast || firstControl[f.Tag] == false) {
+			added = append(added, f)
+		}
+	}
+	addedControls := len(added)
+	for _, f := range nextParsed.fields {
+		if f.IsControl() == false {
+			added = append(added, f)
+		}
+	}
+
+	// make the merged record with the specified number of the added fields
+	build := func(keep int) (Record, error) {
+		controls := addedControls
+		if keep < controls {
+			controls = keep
+		}
+		merged := &marcRecord{leader: firstParsed.leader}
+		merged.fields = make([]MarcField, 0, len(firstFields)+keep)
+		merged.fields = append(merged.fields, firstFields[:insertAt]...)
+		merged.fields = append(merged.fields, added[:controls]...)
+		merged.fields = append(merged.fields, firstFields[insertAt:]...)
+		merged.fields = append(merged.fields, added[controls:keep]...)
+		return newRecordFromParsed(merged, firstImpl.source, firstImpl.format)
+	}
+
+	rec, err := build(len(added))
+	if err == ErrRecordTooLarge {
+		rec, err = mergeOversized(config, first, len(added), build)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	impl := rec.(*recordImpl)
+	impl.offset = firstImpl.offset
+	impl.idRules = firstImpl.idRules
+	impl.honorDeletes = firstImpl.honorDeletes
+	impl.marcId = firstImpl.marcId
+	return rec, nil
+}
+
+// handle a merged record that is too large according to the configured policy
+func mergeOversized(config ServiceConfig, first Record, added int, build func(int) (Record, error)) (Record, error) {
+
+	id, _ := first.Id()
+	impl := first.(*recordImpl)
+
+	switch config.OversizePolicy {
+	case oversizeFirst:
+		log.Printf("WARNING: merged marc record %s is too large, discarding the continuation record", id)
+		return first, nil
+
+	case oversizeTruncate:
+		// discard the trailing continuation fields until the record fits, the fields of the first record are kept
+		for keep := added - 1; keep > 0; keep-- {
+			rec, err := build(keep)
+			if err == nil {
+				log.Printf("WARNING: merged marc record %s is too large, discarded %d continuation field(s)", id, added-keep)
+				return rec, nil
+			}
+			if err != ErrRecordTooLarge {
+				return nil, err
+			}
+		}
+		log.Printf("WARNING: merged marc record %s is too large, discarding the continuation record", id)
+		return first, nil
+
+	default:
+		log.Printf("ERROR: merged marc record %s is too large (%d fields added by the continuation record)", id, added)
+		return nil, newRecordError(impl.offset, fmt.Sprintf("merged record %s is too large", id), nil)
+	}
+}
+
+//
+// end of file
+//
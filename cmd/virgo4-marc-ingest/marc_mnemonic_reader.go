@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// the largest line we will accept in a mnemonic file
+var mnemonicMaxLineSize = 1024 * 1024
+
+// reads MARC mnemonic (MarcEdit .mrk) records. Each record is a series of lines, one per field, and
+// records are separated by one or more blank lines. For example:
+//
+//	=LDR  00000nam  2200000 a 4500
+//	=001  u123456
+//	=245  10$aTitle$cAuthor.
+type marcMnemonicReader struct {
+	DataSource string         // determined from the filename
+	Input      *inputStream   // our input stream
+	scanner    *bufio.Scanner // our line scanner
+	lineNumber int            // used for reporting
+	byteOffset int64          // used for reporting
+	skipping   bool           // skipping the remainder of a bad record
+}
+
+// ErrUnknownMnemonic - a character mnemonic we do not understand
+var ErrUnknownMnemonic = fmt.Errorf("unknown character mnemonic")
+
+// the MARCMaker character mnemonics (https://www.loc.gov/marc/mnemonics.html) as used by MarcEdit. Unicode
+// code points can also be given as {U+XXXX}
+var mnemonicChars = map[string]rune{
+	// ASCII characters, some of these have a special meaning in mnemonic files
+	"excl": '!', "quot": '"', "num": '#', "dollar": '$', "percnt": '%', "amp": '&', "apos": '\'', "lpar": '(',
+	"rpar": ')', "ast": '*', "plus": '+', "comma": ',', "hyphen": '-', "period": '.', "sol": '/', "colon": ':',
+	"semi": ';', "lt": '<', "equals": '=', "gt": '>', "quest": '?', "commat": '@', "lsqb": '[', "bsol": '\\',
+	"rsqb": ']', "lowbar": '_', "lcub": '{', "verbar": '|', "rcub": '}',
+
+	// controls
+	"esc": '\u001B', "joiner": '\u200D', "nonjoin": '\u200C', "nsb": '\u0098', "nse": '\u009C',
+
+	// extended Latin (ANSEL) spacing characters
+	"Lstrok": 'Ł', "Ostrok": 'Ø', "Dstrok": 'Đ', "THORN": 'Þ', "AElig": 'Æ', "OElig": 'Œ', "softsign": 'ʹ',
+	"middot": '·', "flat": '♭', "reg": '®', "plusmn": '±', "Ohorn": 'Ơ', "Uhorn": 'Ư', "mlrhring": 'ʼ',
+	"mllhring": 'ʻ', "lstrok": 'ł', "ostrok": 'ø', "dstrok": 'đ', "thorn": 'þ', "aelig": 'æ', "oelig": 'œ',
+	"hardsign": 'ʺ', "inodot": 'ı', "pound": '£', "eth": 'ð', "ohorn": 'ơ', "uhorn": 'ư', "deg": '°',
+	"scriptl": 'ℓ', "phono": '℗', "copy": '©', "sharp": '♯', "iquest": '¿', "iexcl": '¡', "eszett": 'ß',
+	"szlig": 'ß', "euro": '€',
+
+	// Greek symbols
+	"alpha": 'α', "beta": 'β', "gamma": 'γ',
+
+	// subscripts and superscripts
+	"sub0": '₀', "sub1": '₁', "sub2": '₂', "sub3": '₃', "sub4": '₄', "sub5": '₅', "sub6": '₆', "sub7": '₇',
+	"sub8": '₈', "sub9": '₉', "sub+": '₊', "sub-": '₋', "sub(": '₍', "sub)": '₎',
+	"sup0": '⁰', "sup1": '¹', "sup2": '²', "sup3": '³', "sup4": '⁴', "sup5": '⁵', "sup6": '⁶', "sup7": '⁷',
+	"sup8": '⁸', "sup9": '⁹', "sup+": '⁺', "sup-": '⁻', "sup(": '⁽', "sup)": '⁾',
+}
+
+// the combining diacritic mnemonics, as in MARC-8 they precede the character they modify
+var mnemonicCombining = map[string]rune{
+	"hooka": '\u0309', "grave": '\u0300', "acute": '\u0301', "circ": '\u0302', "tilde": '\u0303',
+	"macr": '\u0304', "breve": '\u0306', "dot": '\u0307', "uml": '\u0308', "diaer": '\u0308',
+	"caron": '\u030C', "ring": '\u030A', "llig": '\uFE20', "rlig": '\uFE21', "rcommaa": '\u0315',
+	"dblac": '\u030B', "candra": '\u0310', "cedil": '\u0327', "ogon": '\u0328', "dotb": '\u0323',
+	"dbldotb": '\u0324', "ringb": '\u0325', "dblunder": '\u0333', "under": '\u0332', "commab": '\u0326',
+	"rcedil": '\u031C', "breveb": '\u032E', "ldbltil": '\uFE22', "rdbltil": '\uFE23', "commaa": '\u0313',
+}
+
+func newMarcMnemonicReader(input *inputStream, source string) recordReader {
+	r := &marcMnemonicReader{Input: input, DataSource: source}
+	r.reset()
+	return r
+}
+
+func (r *marcMnemonicReader) rewind() error {
+
+	err := r.Input.rewind()
+	if err != nil {
+		return err
+	}
+
+	// the scanner buffers so we need a new one
+	r.reset()
+	return nil
+}
+
+func (r *marcMnemonicReader) read() (Record, error) {
+
+	var parsed *marcRecord
+	startLine := 0
+	startOffset := int64(0)
+	for r.scanner.Scan() {
+		lineOffset := r.byteOffset
+		r.byteOffset += int64(len(r.scanner.Bytes()) + 1)
+		r.lineNumber++
+		line := strings.TrimRight(r.scanner.Text(), "\r")
+
+		// a blank line terminates the record (if we have one)
+		if strings.TrimSpace(line) == "" {
+			r.skipping = false
+			if parsed != nil {
+				return r.makeRecord(parsed, startLine, startOffset)
+			}
+			continue
+		}
+
+		// skipping the remainder of a bad record
+		if r.skipping == true {
+			continue
+		}
+
+		if parsed == nil {
+			startLine = r.lineNumber
+			startOffset = lineOffset
+		}
+
+		// every line is of the form =TAG  CONTENT
+		if len(line) < 6 || line[0] != '=' {
+			log.Printf("ERROR: mnemonic line %d is invalid (%s)", r.lineNumber, line)
+			return nil, r.recordError(startOffset, fmt.Sprintf("line %d is invalid", r.lineNumber))
+		}
+
+		tag := line[1:4]
+		content := line[6:]
+
+		if tag == "LDR" {
+			if parsed != nil {
+				log.Printf("ERROR: mnemonic line %d, unexpected leader within record beginning at line %d", r.lineNumber, startLine)
+				return nil, r.recordError(startOffset, fmt.Sprintf("line %d, unexpected leader within record beginning at line %d", r.lineNumber, startLine))
+			}
+			leader := strings.Replace(content, "\\", " ", -1)
+			if len(leader) != marcRecordLeaderSize {
+				log.Printf("ERROR: mnemonic line %d, leader is invalid (%s)", r.lineNumber, content)
+				return nil, r.recordError(startOffset, fmt.Sprintf("line %d, leader is invalid", r.lineNumber))
+			}
+
+			// the mnemonics are decoded to Unicode so the record is always UTF-8
+			decoded := []byte(leader)
+			decoded[9] = 'a'
+			parsed = &marcRecord{leader: string(decoded)}
+			continue
+		}
+
+		if parsed == nil {
+			log.Printf("ERROR: mnemonic line %d, field %s appears before the leader", r.lineNumber, tag)
+			return nil, r.recordError(startOffset, fmt.Sprintf("line %d, field %s appears before the leader", r.lineNumber, tag))
+		}
+
+		field, err := makeMnemonicField(tag, content)
+		if err != nil {
+			log.Printf("ERROR: mnemonic line %d, field %s is invalid (%s): %s", r.lineNumber, tag, err.Error(), content)
+			return nil, r.recordError(startOffset, fmt.Sprintf("line %d, field %s is invalid (%s)", r.lineNumber, tag, err.Error()))
+		}
+		parsed.fields = append(parsed.fields, field)
+	}
+
+	err := r.scanner.Err()
+	if err != nil {
+		log.Printf("ERROR: mnemonic read failure after line %d (%s)", r.lineNumber, err.Error())
+		return nil, err
+	}
+
+	// the last record may not be followed by a blank line
+	if parsed != nil {
+		return r.makeRecord(parsed, startLine, startOffset)
+	}
+
+	return nil, io.EOF
+}
+
+func (r *marcMnemonicReader) close() {
+	r.Input.close()
+}
+
+func (r *marcMnemonicReader) reset() {
+	r.scanner = bufio.NewScanner(r.Input)
+	r.scanner.Buffer(make([]byte, 0, 64*1024), mnemonicMaxLineSize)
+	r.lineNumber = 0
+	r.byteOffset = 0
+	r.skipping = false
+}
+
+// a record level error, the remainder of the record is skipped so we can carry on if necessary
+func (r *marcMnemonicReader) recordError(offset int64, reason string) error {
+	r.skipping = true
+	return newRecordError(offset, reason, nil)
+}
+
+func (r *marcMnemonicReader) makeRecord(parsed *marcRecord, startLine int, startOffset int64) (Record, error) {
+
+	rec, err := newRecordFromParsed(parsed, r.DataSource, recordFormatMnemonic)
+	if err != nil {
+		log.Printf("ERROR: mnemonic record beginning at line %d is invalid (%s)", startLine, err.Error())
+		return nil, newRecordError(startOffset, fmt.Sprintf("record beginning at line %d: %s", startLine, err.Error()), nil)
+	}
+	rec.(*recordImpl).offset = startOffset
+	return rec, nil
+}
+
+// make a field from the mnemonic field content. Blanks in indicators and control fields are represented by
+// a backslash and subfields are delimited by a dollar sign
+func makeMnemonicField(tag string, content string) (MarcField, error) {
+
+	if isControlData(tag, []byte(strings.Replace(content, "$", string(subfieldDelimiter), -1))) == true {
+		value, err := decodeMnemonics(strings.Replace(content, "\\", " ", -1))
+		if err != nil {
+			return MarcField{}, err
+		}
+		return MarcField{Tag: tag, Control: true, Value: value}, nil
+	}
+
+	if len(content) < 2 {
+		return MarcField{}, ErrBadRecord
+	}
+
+	field := MarcField{
+		Tag:        tag,
+		Indicator1: strings.Replace(content[0:1], "\\", " ", -1),
+		Indicator2: strings.Replace(content[1:2], "\\", " ", -1),
+	}
+
+	for _, sf := range strings.Split(content[2:], "$") {
+		if len(sf) == 0 {
+			continue
+		}
+		value, err := decodeMnemonics(sf[1:])
+		if err != nil {
+			return MarcField{}, err
+		}
+		field.Subfields = append(field.Subfields, MarcSubfield{Code: sf[0:1], Value: value})
+	}
+
+	return field, nil
+}
+
+// replace character mnemonics, including unicode code points of the form {U+XXXX}. Combining diacritics are
+// moved after the character they modify as unicode requires. A mnemonic we do not understand is an error
+func decodeMnemonics(value string) (string, error) {
+
+	if strings.IndexByte(value, '{') == -1 {
+		return value, nil
+	}
+
+	var out strings.Builder
+	combining := make([]rune, 0)
+
+	emit := func(r rune) {
+		out.WriteRune(r)
+		for _, c := range combining {
+			out.WriteRune(c)
+		}
+		combining = combining[:0]
+	}
+
+	for ix := 0; ix < len(value); {
+
+		end := -1
+		if value[ix] == '{' {
+			end = strings.IndexByte(value[ix:], '}')
+		}
+
+		// not a mnemonic
+		if end == -1 {
+			r, size := utf8.DecodeRuneInString(value[ix:])
+			emit(r)
+			ix += size
+			continue
+		}
+
+		name := value[ix+1 : ix+end]
+		ix += end + 1
+
+		if r, found := mnemonicChars[name]; found == true {
+			emit(r)
+			continue
+		}
+		if r, found := mnemonicCombining[name]; found == true {
+			combining = append(combining, r)
+			continue
+		}
+		if strings.HasPrefix(name, "U+") {
+			codePoint, err := strconv.ParseUint(name[2:], 16, 32)
+			if err == nil && utf8.ValidRune(rune(codePoint)) == true {
+				emit(rune(codePoint))
+				continue
+			}
+		}
+
+		return "", fmt.Errorf("%w: {%s}", ErrUnknownMnemonic, name)
+	}
+
+	// any trailing combining characters
+	for _, c := range combining {
+		out.WriteRune(c)
+	}
+
+	return out.String(), nil
+}
+
+//
+// end of file
+//
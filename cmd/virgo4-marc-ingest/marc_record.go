@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// MarcSubfield - a single subfield of a data field
+type MarcSubfield struct {
+	Code  string // the subfield code, a single character
+	Value string // the subfield value
+}
+
+// MarcField - a single MARC field. Control fields (001 - 009 and local fields such as FMT) have a value
+// only, data fields have indicators and subfields
+type MarcField struct {
+	Tag        string         // the 3 character field tag
+	Control    bool           // a control field, as determined by the source the field was loaded from
+	Value      string         // control fields only
+	Indicator1 string         // data fields only, a single character
+	Indicator2 string         // data fields only, a single character
+	Subfields  []MarcSubfield // data fields only
+}
+
+// the subfield delimiter
+var subfieldDelimiter = byte(0x1f)
+
+// the size of the MARC leader
+var marcRecordLeaderSize = 24
+
+// the largest record, field and offset that can be represented in the leader and directory
+var marcRecordMaxLength = 99999
+var marcFieldMaxLength = 9999
+
+// the parsed form of a MARC record
+type marcRecord struct {
+	leader string      // the 24 character leader
+	fields []MarcField // all the fields in directory order
+}
+
+// IsControl - is this a control field
+func (f MarcField) IsControl() bool {
+	return f.Control == true || isControlTag(f.Tag)
+}
+
+// Subfield - get the value of the first subfield with the specified code
+func (f MarcField) Subfield(code string) (string, bool) {
+	for _, sf := range f.Subfields {
+		if sf.Code == code {
+			return sf.Value, true
+		}
+	}
+	return "", false
+}
+
+// the field contents as they appear in the record, without the field terminator
+func (f MarcField) data() string {
+
+	if f.IsControl() {
+		return f.Value
+	}
+
+	var b strings.Builder
+	b.WriteString(indicatorOrBlank(f.Indicator1))
+	b.WriteString(indicatorOrBlank(f.Indicator2))
+	for _, sf := range f.Subfields {
+		b.WriteByte(subfieldDelimiter)
+		b.WriteString(sf.Code)
+		b.WriteString(sf.Value)
+	}
+	return b.String()
+}
+
+func indicatorOrBlank(indicator string) string {
+	if len(indicator) == 0 {
+		return " "
+	}
+	return indicator
+}
+
+func isControlTag(tag string) bool {
+	return len(tag) == 3 && strings.HasPrefix(tag, "00")
+}
+
+// ISO 2709 does not say which fields are control fields. Tags 001 - 009 always are and numeric tags above
+// that never are but local fields (such as FMT) can be either, they are control fields if they have no subfields
+func isControlData(tag string, fieldData []byte) bool {
+
+	if isControlTag(tag) == true {
+		return true
+	}
+	if _, err := strconv.Atoi(tag); err == nil {
+		return false
+	}
+	return bytes.IndexByte(fieldData, subfieldDelimiter) == -1
+}
+
+//
+// A marc record consists of a 24 byte leader, the first 5 bytes of which are the record length (in ascii) followed
+// by a 'directory' of fields. The offset of the end of the directory is specified at byte 12 for 5 bytes.
+// All field descriptors within the directory consist of the following:
+//    field Id (string) bytes 0 - 2 (3 bytes)
+//    field length (string) bytes 3 - 6 (4 bytes)
+//    field offset (string) bytes 7 - 11 (5 bytes)
+//
+// The actual field values begin after the end of the directory.
+//
+
+func parseMarcRecord(raw []byte) (*marcRecord, error) {
+
+	if len(raw) < marcRecordLeaderSize {
+		log.Printf("ERROR: marc record too short (%d bytes)", len(raw))
+		return nil, ErrBadRecord
+	}
+
+	endOfDir, err := strconv.Atoi(string(raw[12:17]))
+	if err != nil || isAsciiDigits(raw[12:17]) == false {
+		log.Printf("ERROR: marc record end of directory offset invalid (%s)", string(raw[12:17]))
+		return nil, ErrBadRecord
+	}
+
+	// make sure we are actually pointing where we expect
+	if endOfDir == 99999 || endOfDir <= marcRecordFieldDirStart || endOfDir > len(raw) || raw[endOfDir-1] != fieldTerminator {
+		foundIx := bytes.IndexByte(raw, fieldTerminator)
+		if foundIx == -1 {
+			log.Printf("ERROR: cannot locate end of directory marker")
+			return nil, ErrBadRecord
+		}
+		foundIx++
+		log.Printf("INFO: resetting directory terminator. was %d, now %d", endOfDir, foundIx)
+		endOfDir = foundIx
+	}
+
+	rec := &marcRecord{leader: string(raw[0:marcRecordLeaderSize])}
+	currentOffset := marcRecordFieldDirStart
+	for currentOffset+marcRecordFieldDirEntrySize < endOfDir {
+		dirEntry := raw[currentOffset : currentOffset+marcRecordFieldDirEntrySize]
+		//log.Printf( "Dir entry [%s]", string( dirEntry ) )
+
+		// strconv accepts a sign so we insist on digits, anything else is a corrupt directory
+		if isPlausibleTag(dirEntry[0:3]) == false || isAsciiDigits(dirEntry[3:7]) == false || isAsciiDigits(dirEntry[7:12]) == false {
+			log.Printf("ERROR: marc record directory entry invalid (%s)", string(dirEntry))
+			return nil, ErrBadRecord
+		}
+		tag := string(dirEntry[0:3])
+		fieldLength, _ := strconv.Atoi(string(dirEntry[3:7]))
+		fieldOffset, _ := strconv.Atoi(string(dirEntry[7:12]))
+
+		fieldStart := endOfDir + fieldOffset
+		fieldEnd := fieldStart + fieldLength
+		currentOffset += marcRecordFieldDirEntrySize
+
+		if fieldLength <= 0 || fieldStart < endOfDir || fieldEnd > len(raw) {
+			log.Printf("ERROR: marc record field %s out of bounds (offset %d, length %d)", tag, fieldOffset, fieldLength)
+			return nil, ErrBadRecord
+		}
+
+		fieldData := raw[fieldStart:fieldEnd]
+		if fieldData[len(fieldData)-1] == fieldTerminator {
+			fieldData = fieldData[:len(fieldData)-1]
+		}
+
+		rec.fields = append(rec.fields, makeMarcField(tag, fieldData))
+	}
+
+	return rec, nil
+}
+
+// are the bytes all ASCII digits
+func isAsciiDigits(value []byte) bool {
+	for _, b := range value {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return len(value) != 0
+}
+
+// tags are numeric except for local fields (such as FMT) which may use ASCII letters
+func isPlausibleTag(tag []byte) bool {
+	for _, b := range tag {
+		if (b < '0' || b > '9') && (b < 'A' || b > 'Z') && (b < 'a' || b > 'z') {
+			return false
+		}
+	}
+	return len(tag) == 3
+}
+
+// make a field from the field data (without the field terminator)
+func makeMarcField(tag string, fieldData []byte) MarcField {
+
+	field := MarcField{Tag: tag}
+	if isControlData(tag, fieldData) == true {
+		field.Control = true
+		field.Value = string(fieldData)
+		return field
+	}
+
+	// data fields begin with 2 indicators, tolerate them being absent
+	if len(fieldData) > 0 && fieldData[0] != subfieldDelimiter {
+		field.Indicator1 = string(fieldData[0:1])
+		fieldData = fieldData[1:]
+	}
+	if len(fieldData) > 0 && fieldData[0] != subfieldDelimiter {
+		field.Indicator2 = string(fieldData[0:1])
+		fieldData = fieldData[1:]
+	}
+
+	for _, sf := range bytes.Split(fieldData, []byte{subfieldDelimiter}) {
+		if len(sf) == 0 {
+			continue
+		}
+		field.Subfields = append(field.Subfields, MarcSubfield{Code: string(sf[0:1]), Value: string(sf[1:])})
+	}
+
+	return field
+}
+
+// serialize the record in ISO 2709 form. The leader record length and base address are recalculated
+func (m *marcRecord) marshal() ([]byte, error) {
+
+	var directory bytes.Buffer
+	var data bytes.Buffer
+	for _, f := range m.fields {
+
+		if len(f.Tag) != 3 {
+			log.Printf("ERROR: marc field tag invalid (%s)", f.Tag)
+			return nil, ErrBadRecord
+		}
+
+		fieldData := f.data() + string(fieldTerminator)
+		if len(fieldData) > marcFieldMaxLength {
+			log.Printf("ERROR: marc field %s too large (%d bytes)", f.Tag, len(fieldData))
+			return nil, ErrRecordTooLarge
+		}
+
+		directory.WriteString(fmt.Sprintf("%s%04d%05d", f.Tag, len(fieldData), data.Len()))
+		data.WriteString(fieldData)
+	}
+	directory.WriteByte(fieldTerminator)
+
+	baseAddress := marcRecordLeaderSize + directory.Len()
+	length := baseAddress + data.Len() + 1
+	if length > marcRecordMaxLength {
+		log.Printf("ERROR: marc record too large (%d bytes)", length)
+		return nil, ErrRecordTooLarge
+	}
+
+	leader := []byte(fmt.Sprintf("%-24s", m.leader))[0:marcRecordLeaderSize]
+	copy(leader[0:5], fmt.Sprintf("%05d", length))
+	copy(leader[10:12], "22")
+	copy(leader[12:17], fmt.Sprintf("%05d", baseAddress))
+	copy(leader[20:24], "4500")
+
+	raw := make([]byte, 0, length)
+	raw = append(raw, leader...)
+	raw = append(raw, directory.Bytes()...)
+	raw = append(raw, data.Bytes()...)
+	raw = append(raw, recordTerminator)
+	return raw, nil
+}
+
+// get all fields with the specified tag, all fields if the tag is blank
+func (m *marcRecord) getFields(tag string) []MarcField {
+
+	fields := make([]MarcField, 0)
+	for _, f := range m.fields {
+		if tag == "" || f.Tag == tag {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// get the values of all the subfields with the specified code from all fields with the specified tag
+func (m *marcRecord) getSubfields(tag string, code string) []string {
+
+	values := make([]string, 0)
+	for _, f := range m.fields {
+		if f.Tag != tag {
+			continue
+		}
+		for _, sf := range f.Subfields {
+			if sf.Code == code {
+				values = append(values, sf.Value)
+			}
+		}
+	}
+	return values
+}
+
+//
+// end of file
+//
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// reads MARC-in-JSON records. The file may contain a single record, an array of records or a
+// sequence of records (typically one per line)
+type marcJsonReader struct {
+	DataSource  string        // determined from the filename
+	Input       *inputStream  // our input stream
+	decoder     *json.Decoder // the streaming decoder
+	inArray     bool          // are the records contained within an array
+	recordIndex int           // used for reporting
+}
+
+func newMarcJsonReader(input *inputStream, source string) recordReader {
+	return &marcJsonReader{Input: input, DataSource: source}
+}
+
+func (r *marcJsonReader) rewind() error {
+
+	err := r.Input.rewind()
+	if err != nil {
+		return err
+	}
+
+	// the decoder buffers so we need a new one
+	r.decoder = nil
+	return nil
+}
+
+func (r *marcJsonReader) read() (Record, error) {
+
+	if r.decoder == nil {
+		err := r.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// are we at the end of the array
+	if r.inArray == true && r.decoder.More() == false {
+		return nil, io.EOF
+	}
+
+	offset := r.decoder.InputOffset()
+	jsonRec := MarcJsonRecord{}
+	err := r.decoder.Decode(&jsonRec)
+	if err != nil {
+		if err == io.EOF || isReadFailure(err) == true {
+			return nil, err
+		}
+		log.Printf("ERROR: marc json record index %d near byte offset %d cannot be decoded (%s)", r.recordIndex, offset, err.Error())
+
+		// a type error means the decoder has moved past this record so we can carry on if necessary,
+		// anything else is a syntax error and we cannot
+		if _, ok := err.(*json.UnmarshalTypeError); ok == true {
+			r.recordIndex++
+			return nil, newRecordError(offset, err.Error(), nil)
+		}
+		return nil, ErrBadRecord
+	}
+
+	r.recordIndex++
+	rec, err := makeRecordFromJson(jsonRec, r.DataSource)
+	if err != nil {
+		log.Printf("ERROR: marc json record index %d near byte offset %d is invalid (%s)", r.recordIndex-1, offset, err.Error())
+		return nil, newRecordError(offset, err.Error(), nil)
+	}
+
+	rec.(*recordImpl).offset = offset
+	return rec, nil
+}
+
+func (r *marcJsonReader) close() {
+	r.Input.close()
+}
+
+// create the decoder and determine if the records are contained within an array
+func (r *marcJsonReader) start() error {
+
+	for {
+		b, err := r.Input.peek(1)
+		if err != nil {
+			return err
+		}
+
+		// ignore leading whitespace and any byte order mark
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' || b[0] == 0xef || b[0] == 0xbb || b[0] == 0xbf {
+			r.Input.discard(1)
+			continue
+		}
+
+		r.inArray = b[0] == '['
+		break
+	}
+
+	r.decoder = json.NewDecoder(r.Input)
+	r.recordIndex = 0
+
+	// consume the array opening
+	if r.inArray == true {
+		_, err := r.decoder.Token()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convert a decoded MARC-in-JSON record into our record representation
+func makeRecordFromJson(jsonRec MarcJsonRecord, source string) (Record, error) {
+
+	if len(jsonRec.Leader) != marcRecordLeaderSize {
+		log.Printf("ERROR: marc json leader is invalid (%s)", jsonRec.Leader)
+		return nil, ErrBadRecord
+	}
+
+	// MARC-in-JSON is always UTF-8
+	leader := []byte(jsonRec.Leader)
+	leader[9] = 'a'
+
+	parsed := &marcRecord{leader: string(leader)}
+	for _, f := range jsonRec.Fields {
+
+		// each field is an object with a single member, the name being the tag
+		if len(f) != 1 {
+			log.Printf("ERROR: marc json field has %d members, expected 1", len(f))
+			return nil, ErrBadRecord
+		}
+
+		for tag, value := range f {
+
+			// control fields are strings, data fields are objects
+			if isControlTag(tag) || isJsonString(value) {
+				controlValue := ""
+				err := json.Unmarshal(value, &controlValue)
+				if err != nil {
+					log.Printf("ERROR: marc json control field %s is invalid (%s)", tag, err.Error())
+					return nil, ErrBadRecord
+				}
+				parsed.fields = append(parsed.fields, MarcField{Tag: tag, Control: true, Value: controlValue})
+				continue
+			}
+
+			df := MarcJsonDataField{}
+			err := json.Unmarshal(value, &df)
+			if err != nil {
+				log.Printf("ERROR: marc json data field %s is invalid (%s)", tag, err.Error())
+				return nil, ErrBadRecord
+			}
+
+			field := MarcField{Tag: tag, Indicator1: df.Ind1, Indicator2: df.Ind2}
+			for _, sf := range df.Subfields {
+				for code, sfValue := range sf {
+					field.Subfields = append(field.Subfields, MarcSubfield{Code: code, Value: sfValue})
+				}
+			}
+			parsed.fields = append(parsed.fields, field)
+		}
+	}
+
+	return newRecordFromParsed(parsed, source, recordFormatJson)
+}
+
+func isJsonString(value json.RawMessage) bool {
+	trimmed := bytes.TrimLeft(value, " \t\r\n")
+	return len(trimmed) != 0 && trimmed[0] == '"'
+}
+
+//
+// end of file
+//
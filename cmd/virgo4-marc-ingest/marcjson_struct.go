@@ -0,0 +1,20 @@
+package main
+
+import "encoding/json"
+
+// this describes the structure of a MARC-in-JSON record (https://rossfsinger.com/blog/2010/09/a-proposal-to-serialize-marc-in-json/)
+
+type MarcJsonRecord struct {
+	Leader string                       `json:"leader"`
+	Fields []map[string]json.RawMessage `json:"fields"`
+}
+
+type MarcJsonDataField struct {
+	Ind1      string              `json:"ind1"`
+	Ind2      string              `json:"ind2"`
+	Subfields []map[string]string `json:"subfields"`
+}
+
+//
+// end of file
+//
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+)
+
+// the MARCXML namespace
+var marcXmlNamespace = "http://www.loc.gov/MARC21/slim"
+
+// reads MARCXML records, either standalone or within a collection. The file is streamed so the
+// collection can be arbitrarily large
+type marcXmlReader struct {
+	DataSource  string       // determined from the filename
+	Input       *inputStream // our input stream
+	decoder     *xml.Decoder // the streaming decoder
+	recordIndex int          // used for reporting
+}
+
+func newMarcXmlReader(input *inputStream, source string) recordReader {
+	return &marcXmlReader{Input: input, DataSource: source, decoder: xml.NewDecoder(input)}
+}
+
+func (r *marcXmlReader) rewind() error {
+
+	err := r.Input.rewind()
+	if err != nil {
+		return err
+	}
+
+	// the decoder buffers so we need a new one
+	r.decoder = xml.NewDecoder(r.Input)
+	r.recordIndex = 0
+	return nil
+}
+
+func (r *marcXmlReader) read() (Record, error) {
+
+	for {
+		token, err := r.decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+			if isReadFailure(err) == true {
+				return nil, err
+			}
+			log.Printf("ERROR: marcxml parse failure after record index %d near byte offset %d (%s)", r.recordIndex, r.decoder.InputOffset(), err.Error())
+			return nil, ErrBadRecord
+		}
+
+		// we are only interested in record elements, everything else (collection, comments, etc) is ignored
+		start, ok := token.(xml.StartElement)
+		if ok == false || start.Name.Local != "record" {
+			continue
+		}
+
+		offset := r.decoder.InputOffset()
+		xmlRec := MarcXmlRecord{}
+		err = r.decoder.DecodeElement(&xmlRec, &start)
+		if err != nil {
+			if isReadFailure(err) == true {
+				return nil, err
+			}
+			log.Printf("ERROR: marcxml record index %d near byte offset %d cannot be decoded (%s)", r.recordIndex, offset, err.Error())
+			return nil, ErrBadRecord
+		}
+
+		// the decoder has moved past this record so we can carry on if necessary
+		r.recordIndex++
+		rec, err := makeRecordFromXml(xmlRec, r.DataSource)
+		if err != nil {
+			log.Printf("ERROR: marcxml record index %d near byte offset %d is invalid (%s)", r.recordIndex-1, offset, err.Error())
+			return nil, newRecordError(offset, err.Error(), nil)
+		}
+
+		rec.(*recordImpl).offset = offset
+		return rec, nil
+	}
+}
+
+func (r *marcXmlReader) close() {
+	r.Input.close()
+}
+
+// convert a decoded MARCXML record into our record representation
+func makeRecordFromXml(xmlRec MarcXmlRecord, source string) (Record, error) {
+
+	if len(xmlRec.Leader) != marcRecordLeaderSize {
+		log.Printf("ERROR: marcxml leader is invalid (%s)", xmlRec.Leader)
+		return nil, ErrBadRecord
+	}
+
+	// MARCXML is always UTF-8
+	leader := []byte(xmlRec.Leader)
+	leader[9] = 'a'
+
+	parsed := &marcRecord{leader: string(leader)}
+	for _, cf := range xmlRec.ControlFields {
+		parsed.fields = append(parsed.fields, MarcField{Tag: cf.Tag, Control: true, Value: cf.Value})
+	}
+
+	for _, df := range xmlRec.DataFields {
+		field := MarcField{Tag: df.Tag, Indicator1: df.Ind1, Indicator2: df.Ind2}
+		for _, sf := range df.Subfields {
+			field.Subfields = append(field.Subfields, MarcSubfield{Code: sf.Code, Value: sf.Value})
+		}
+		parsed.fields = append(parsed.fields, field)
+	}
+
+	return newRecordFromParsed(parsed, source, recordFormatXml)
+}
+
+// serialize the record as a standalone MARCXML record
+func (m *marcRecord) marshalXml() ([]byte, error) {
+
+	xmlRec := MarcXmlRecord{Xmlns: marcXmlNamespace, Leader: m.leader}
+	for _, f := range m.fields {
+		if f.IsControl() {
+			xmlRec.ControlFields = append(xmlRec.ControlFields, MarcXmlControlField{Tag: f.Tag, Value: f.Value})
+			continue
+		}
+
+		df := MarcXmlDataField{Tag: f.Tag, Ind1: indicatorOrBlank(f.Indicator1), Ind2: indicatorOrBlank(f.Indicator2)}
+		for _, sf := range f.Subfields {
+			df.Subfields = append(df.Subfields, MarcXmlSubfield{Code: sf.Code, Value: sf.Value})
+		}
+		xmlRec.DataFields = append(xmlRec.DataFields, df)
+	}
+
+	return xml.Marshal(xmlRec)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,34 @@
+package main
+
+import "encoding/xml"
+
+// this describes the structure of a MARCXML record
+
+type MarcXmlRecord struct {
+	XMLName       xml.Name              `xml:"record"`
+	Xmlns         string                `xml:"xmlns,attr,omitempty"`
+	Leader        string                `xml:"leader"`
+	ControlFields []MarcXmlControlField `xml:"controlfield"`
+	DataFields    []MarcXmlDataField    `xml:"datafield"`
+}
+
+type MarcXmlControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type MarcXmlDataField struct {
+	Tag       string            `xml:"tag,attr"`
+	Ind1      string            `xml:"ind1,attr"`
+	Ind2      string            `xml:"ind2,attr"`
+	Subfields []MarcXmlSubfield `xml:"subfield"`
+}
+
+type MarcXmlSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+//
+// end of file
+//
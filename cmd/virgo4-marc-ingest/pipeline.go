@@ -0,0 +1,523 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// an inbound message and the files it describes
+type inboundNotification struct {
+	files         []InboundFile
+	receiptHandle awssqs.ReceiptHandle
+}
+
+// an inbound file that has been downloaded and expanded, or the reason it could not be
+type downloadedFile struct {
+	remoteName string      // the inbound file
+	expanded   []NameTuple // the files it expanded into
+	err        error       // why it could not be downloaded or expanded
+}
+
+//
+// processes inbound notifications, each in its own pipeline. Several notifications can be processed at once so
+// several files feed the workers at once, but the files of a single notification are processed in order (so
+// duplicate detection behaves as it always has) and each file is ingested by a single goroutine so its records
+// reach the workers in file order. Notifications about an object that is already being processed wait for
+// the earlier one to finish.
+//
+type ingestPipelines struct {
+	cfg       ServiceConfig
+	aws       awssqs.AWS_SQS
+	s3Svc     uva_s3.UvaS3
+	streamer  *s3Streamer
+	store     *stateStore     // the local state (optional)
+	sequencer *eventSequencer // used to ignore events that are older than ones we have already processed
+	keeper    *messageKeeper  // keeps the inbound messages from being redelivered while we are busy with them
+	inQueue   awssqs.QueueHandle
+	records   chan<- Record
+
+	slots    chan struct{}            // one for each notification (or held full dump) being processed
+	lock     sync.Mutex               // protects the objects and held full dumps being processed
+	inflight map[string]chan struct{} // the objects being processed, closed once the last notification about each is done
+	held     map[string]bool          // the data sources of the held full dumps being ingested
+}
+
+func newIngestPipelines(cfg ServiceConfig, aws awssqs.AWS_SQS, s3Svc uva_s3.UvaS3, streamer *s3Streamer, store *stateStore,
+	sequencer *eventSequencer, keeper *messageKeeper, inQueue awssqs.QueueHandle, records chan<- Record) *ingestPipelines {
+
+	return &ingestPipelines{
+		cfg:       cfg,
+		aws:       aws,
+		s3Svc:     s3Svc,
+		streamer:  streamer,
+		store:     store,
+		sequencer: sequencer,
+		keeper:    keeper,
+		inQueue:   inQueue,
+		records:   records,
+		slots:     make(chan struct{}, cfg.Pipelines),
+		inflight:  make(map[string]chan struct{}),
+		held:      make(map[string]bool),
+	}
+}
+
+// wait until at least one pipeline is free, returns the number of free pipelines which are now reserved
+func (p *ingestPipelines) reserve() int {
+
+	p.slots <- struct{}{}
+	count := 1
+	for uint(count) < awssqs.MAX_SQS_BLOCK_COUNT {
+		select {
+		case p.slots <- struct{}{}:
+			count++
+		default:
+			return count
+		}
+	}
+	return count
+}
+
+// give back pipelines we reserved but did not use
+func (p *ingestPipelines) unreserve(count int) {
+	for i := 0; i < count; i++ {
+		<-p.slots
+	}
+}
+
+// process a notification in a reserved pipeline
+func (p *ingestPipelines) start(notification inboundNotification) {
+
+	// we only delete the inbound message once every record has been delivered so, if we fail part way
+	// through, the notification will be redelivered
+	kept := p.keeper.keep(p.inQueue, notification.receiptHandle)
+
+	done := make(chan struct{})
+	earlier := p.claim(notification.files, done)
+
+	go func() {
+		defer p.unreserve(1)
+		defer p.release(notification.files, done)
+
+		for _, wait := range earlier {
+			<-wait
+		}
+
+		// we carry on with the other notifications, this one is redelivered once its visibility timeout expires
+		err := p.process(notification, kept)
+		if err != nil {
+			log.Printf("ERROR: unable to process notification, it will be redelivered (%s)", err.Error())
+			kept.release()
+		}
+	}()
+}
+
+// ingest an approved held full dump in a free pipeline, if there is none we try again next time
+func (p *ingestPipelines) startHeld(h heldDump) {
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		log.Printf("INFO: no free pipeline for held full dump %s for %s, waiting", h.File, h.Source)
+		return
+	}
+
+	p.lock.Lock()
+	p.held[h.Source] = true
+	p.lock.Unlock()
+
+	go func() {
+		defer p.unreserve(1)
+		defer func() {
+			p.lock.Lock()
+			delete(p.held, h.Source)
+			p.lock.Unlock()
+		}()
+
+		err := ingestHeldDump(p.cfg, p.store, p.s3Svc, h, p.records)
+		if err != nil {
+			log.Printf("ERROR: unable to ingest held full dump %s for %s, it will be tried again (%s)", h.File, h.Source, err.Error())
+		}
+	}()
+}
+
+// is the held full dump for the data source being ingested
+func (p *ingestPipelines) heldInProgress(source string) bool {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.held[source]
+}
+
+// note the objects we are about to process, returns the earlier notifications about the same objects that we
+// must wait for
+func (p *ingestPipelines) claim(files []InboundFile, done chan struct{}) []chan struct{} {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	earlier := make([]chan struct{}, 0)
+	for _, f := range files {
+		name := eventObjectName(f)
+		if wait, found := p.inflight[name]; found == true && wait != done {
+			log.Printf("INFO: %s is already being processed, waiting for it", name)
+			earlier = append(earlier, wait)
+		}
+		p.inflight[name] = done
+	}
+	return earlier
+}
+
+// we are done with the objects
+func (p *ingestPipelines) release(files []InboundFile, done chan struct{}) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, f := range files {
+		name := eventObjectName(f)
+		if p.inflight[name] == done {
+			delete(p.inflight, name)
+		}
+	}
+	close(done)
+}
+
+// process the files from a notification and then delete it
+func (p *ingestPipelines) process(notification inboundNotification, kept *keptMessage) error {
+
+	batch := newIngestBatch(p.cfg, p.store)
+
+	// while we were waiting, we may have processed a later event for the same object
+	files, err := p.sequencer.current(notification.files)
+	if err != nil {
+		return err
+	}
+
+	if p.cfg.StreamIngest == true {
+		err = p.streamFiles(files, batch)
+	} else {
+		err = p.downloadFiles(files, batch)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the files have been ingested or rejected and reported, we do not want the notification redelivered
+	return finishInboundMessage(p.aws, p.inQueue, notification.receiptHandle, kept, batch, p.sequencer, notification.files)
+}
+
+// stream each file directly from S3
+func (p *ingestPipelines) streamFiles(files []InboundFile, batch *ingestBatch) error {
+
+	for _, f := range files {
+
+		// VIRGONEW-2419
+		if f.ObjectSize == 0 {
+			log.Printf("INFO: notification is reporting %s/%s is ZERO length, ignoring", f.SourceBucket, f.SourceKey)
+			continue
+		}
+
+		err := streamInboundFile(p.cfg, p.streamer, p.s3Svc, f, batch, p.records)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// download each file and validate it, record ids are tracked across the whole batch. The next file is downloaded
+// while the previous one is validated. Once they are all valid, the files are ingested
+func (p *ingestPipelines) downloadFiles(files []InboundFile, batch *ingestBatch) error {
+
+	var err error
+	fileSets := make([]NameTuple, 0)
+	validFiles := make([]NameTuple, 0)
+
+	// when we are done, stop downloading and remove anything that was downloaded after we stopped. If we
+	// failed part way through, the files we have not yet removed are removed too
+	quit := make(chan struct{})
+	downloaded := p.download(files, quit)
+	defer func() {
+		close(quit)
+		for d := range downloaded {
+			removeFiles(d.expanded)
+		}
+		removeFiles(fileSets)
+	}()
+
+	for d := range downloaded {
+
+		if d.err != nil {
+			// a corrupt or truncated file is invalid, anything else is some other sort of failure
+			if isExpansionFailure(d.err) == false {
+				return d.err
+			}
+
+			log.Printf("ERROR: %s cannot be expanded, ignoring it (%s)", d.remoteName, d.err.Error())
+			r := writeRejectReport(p.cfg, p.s3Svc, RejectReport{File: d.remoteName, Rejected: true, Reason: d.err.Error()})
+			if r != nil {
+				return r
+			}
+
+			if p.cfg.ErrorPolicy != errorPolicyRejectBatch {
+				// reject this file only and carry on with the remainder
+				continue
+			}
+
+			err = d.err
+			break
+		}
+
+		// update our list of files to be processed
+		expanded := d.expanded
+		fileSets = append(fileSets, expanded...)
+
+		for _, file := range expanded {
+
+			log.Printf("INFO: validating %s (%s)", file.RemoteName, file.LocalName)
+
+			// create a new loader
+			loader, e := NewRecordLoader(fileConfig(p.cfg, file), file.RemoteName, file.LocalName)
+			if e != nil {
+				return e
+			}
+
+			// validate the file
+			loader.TrackDuplicates(batch.duplicates)
+			e = loader.Validate()
+			badRecords := loader.BadRecords()
+			file.index = loader.Index()
+			source := recordSource(fileConfig(p.cfg, file), loader)
+			loader.Done()
+
+			// when quarantining, too many bad records means we reject the file anyway
+			if e == nil && p.cfg.ErrorPolicy == errorPolicyQuarantine && len(badRecords) > p.cfg.BadRecordThreshold {
+				log.Printf("ERROR: %s (%s) has %d bad records, threshold is %d", file.RemoteName, file.LocalName, len(badRecords), p.cfg.BadRecordThreshold)
+				e = ErrTooManyBadRecords
+			}
+
+			// strict validation is in addition to the above
+			if e == nil && p.cfg.StrictValidation == true {
+				report, r := strictValidateFile(fileConfig(p.cfg, file), file.RemoteName, file.LocalName)
+				if r != nil {
+					return r
+				}
+				r = writeValidationReport(p.cfg, p.s3Svc, report)
+				if r != nil {
+					return r
+				}
+				if report.Errors != 0 {
+					log.Printf("ERROR: %s (%s) has %d strict validation errors", file.RemoteName, file.LocalName, report.Errors)
+					e = ErrStrictValidationFailed
+				}
+			}
+
+			// a full dump that looks suspicious is held, nothing in it is published until an operator approves it
+			if e == nil {
+				held, r := checkFullDumpFile(p.cfg, p.store, source, file, loader.Records())
+				if r != nil {
+					return r
+				}
+				if held != nil {
+					r = holdLocalFile(p.cfg, p.store, *held, file.LocalName)
+					if r != nil {
+						return r
+					}
+					batch.duplicates.forget(file.RemoteName)
+					log.Printf("INFO: removing held file %s", file.LocalName)
+					r = os.Remove(file.LocalName)
+					if r != nil {
+						return r
+					}
+					fileSets = withoutFile(fileSets, file.LocalName)
+					continue
+				}
+			}
+
+			if e == nil {
+				log.Printf("INFO: %s (%s) appears to be OK, ready for ingest", file.RemoteName, file.LocalName)
+				batch.duplicates.accept(file.RemoteName)
+				if len(badRecords) != 0 {
+					e = writeRejectReport(p.cfg, p.s3Svc, RejectReport{File: file.RemoteName, BadRecords: badRecords})
+					if e != nil {
+						return e
+					}
+				}
+				validFiles = append(validFiles, file)
+				continue
+			}
+
+			log.Printf("ERROR: %s (%s) appears to be invalid, ignoring it (%s)", file.RemoteName, file.LocalName, e.Error())
+			r := writeRejectReport(p.cfg, p.s3Svc, RejectReport{File: file.RemoteName, Rejected: true, Reason: e.Error(), BadRecords: badRecords})
+			if r != nil {
+				return r
+			}
+
+			// this file will not be ingested so its records cannot duplicate any others
+			batch.duplicates.forget(file.RemoteName)
+
+			if p.cfg.ErrorPolicy != errorPolicyRejectBatch {
+				// reject this file only and carry on with the remainder
+				log.Printf("INFO: removing invalid file %s", file.LocalName)
+				r = os.Remove(file.LocalName)
+				if r != nil {
+					return r
+				}
+				continue
+			}
+
+			err = e
+			break
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// one of the files was invalid, we need to ignore the entire batch and delete the local files
+	if err != nil {
+		for _, f := range fileSets {
+			log.Printf("INFO: removing invalid file %s", f.LocalName)
+			e := os.Remove(f.LocalName)
+			if e != nil && os.IsNotExist(e) == false {
+				return e
+			}
+		}
+		return nil
+	}
+
+	// now we can process each of the viable inbound files
+	for _, file := range validFiles {
+
+		start := time.Now()
+		log.Printf("INFO: processing %s (%s)", file.RemoteName, file.LocalName)
+
+		// we have already validated the file and believe it to be correct so any error is some other sort of failure
+		fileCfg := fileConfig(p.cfg, file)
+		loader, err := NewRecordLoader(fileCfg, file.RemoteName, file.LocalName)
+		if err != nil {
+			return err
+		}
+
+		// the records are parsed in parallel if the file was indexed when it was validated
+		loader.UseIndex(file.index)
+
+		count, err := ingestRecords(fileCfg, file, loader, batch, p.records)
+		if err != nil {
+			return err
+		}
+
+		skipped := len(loader.BadRecords())
+		loader.Done()
+		duration := time.Since(start)
+		log.Printf("INFO: done processing %s (%s). %d records, %d skipped, %d duplicates, %d unchanged (%0.2f tps)", file.RemoteName, file.LocalName,
+			count, skipped, batch.duplicates.duplicates(file.RemoteName), batch.changes.unchangedCount(file.RemoteName), float64(count)/duration.Seconds())
+
+		// file has been ingested, remove it
+		log.Printf("INFO: removing processed file %s", file.LocalName)
+		err = os.Remove(file.LocalName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the files without the specified one
+func withoutFile(files []NameTuple, localName string) []NameTuple {
+
+	remaining := make([]NameTuple, 0, len(files))
+	for _, f := range files {
+		if f.LocalName != localName {
+			remaining = append(remaining, f)
+		}
+	}
+	return remaining
+}
+
+// download the files one after another, each is passed on (expanded if necessary) as soon as it has been
+// downloaded. We stop when asked to
+func (p *ingestPipelines) download(files []InboundFile, quit <-chan struct{}) <-chan downloadedFile {
+
+	// we only download one file ahead
+	downloaded := make(chan downloadedFile, 1)
+
+	go func() {
+		defer close(downloaded)
+
+		for _, f := range files {
+
+			// save the remote name, we will need it later
+			file := NameTuple{
+				RemoteName: fmt.Sprintf("%s/%s", f.SourceBucket, f.SourceKey),
+				ObjectSize: f.ObjectSize,
+				ETag:       f.ETag,
+			}
+
+			// VIRGONEW-2419
+			if f.ObjectSize == 0 {
+				log.Printf("INFO: notification is reporting %s is ZERO length, ignoring", file.RemoteName)
+				continue
+			}
+
+			// download the file, we give up on the remainder if we cannot
+			err := p.downloadFile(f, &file)
+			if err != nil {
+				select {
+				case downloaded <- downloadedFile{remoteName: file.RemoteName, err: err}:
+				case <-quit:
+				}
+				return
+			}
+
+			// decompress the file if necessary, archives expand into one file per member. A file we cannot
+			// expand is passed on so it can be rejected
+			expanded, err := expandInboundFile(p.cfg, file)
+
+			select {
+			case downloaded <- downloadedFile{remoteName: file.RemoteName, expanded: expanded, err: err}:
+			case <-quit:
+				removeFiles(expanded)
+				return
+			}
+		}
+	}()
+
+	return downloaded
+}
+
+// download a file to a temp file, the specific version if the event was about one
+func (p *ingestPipelines) downloadFile(f InboundFile, file *NameTuple) error {
+
+	tmp, err := ioutil.TempFile(p.cfg.DownloadDir, "")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	file.LocalName = tmp.Name()
+
+	if f.VersionId != "" {
+		err = p.streamer.download(f, file.LocalName)
+	} else {
+		o := uva_s3.NewUvaS3Object(f.SourceBucket, f.SourceKey)
+		err = p.s3Svc.GetToFile(o, file.LocalName)
+	}
+	if err != nil {
+		os.Remove(file.LocalName)
+	}
+	return err
+}
+
+//
+// end of file
+//
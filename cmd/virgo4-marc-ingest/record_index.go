@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// the parsers are given runs of records, reading and handing them over one at a time costs more than parsing them
+var indexBatchSize = 256
+
+// the number of batches each parser can be ahead of the record being returned
+var indexReadAhead = 4
+
+// ErrIndexMismatch - the file no longer matches the index built when it was validated
+var ErrIndexMismatch = fmt.Errorf("record index does not match the file")
+
+// where a record is within the file
+type recordSegment struct {
+	offset int64 // the byte offset of the record
+	length int   // the raw record length
+}
+
+// an indexed record, continuation records that were merged into it have their own segment
+type recordIndexEntry struct {
+	id       string          // the record id
+	segments []recordSegment // the raw records in file order
+}
+
+//
+// the records in a file, built when the file is validated. Validation has already located the records, merged
+// any continuation records and skipped the bad ones so, when the file is ingested, the records can be read
+// directly from the file and parsed in parallel. Only binary MARC files from a local file can be indexed as
+// the other formats do not have exact record offsets.
+//
+type recordIndex struct {
+	entries    []recordIndexEntry // the records in file order
+	badRecords []BadRecord        // the bad records found during validation
+}
+
+// note a record returned by the loader
+func (i *recordIndex) add(rec Record) {
+
+	if i == nil {
+		return
+	}
+
+	id, _ := rec.Id()
+	i.entries = append(i.entries, recordIndexEntry{id: id, segments: rec.(*recordImpl).segments})
+}
+
+// the records (or error) from a parser
+type indexedBatch struct {
+	recs []Record
+	err  error
+}
+
+// a run of records for a parser to load, the result is returned on the channel
+type indexedJob struct {
+	entries []recordIndexEntry
+	result  chan indexedBatch
+}
+
+// reads the records in an index using a set of parsers, the records are returned in file order
+type indexedReader struct {
+	ordered chan chan indexedBatch // the result channels in file order
+	quit    chan struct{}          // closed to stop everything
+	current []Record               // the remainder of the batch being returned
+}
+
+func (l *recordLoaderImpl) Index() *recordIndex {
+	return l.index
+}
+
+// use the index built when the file was validated, nil to read the file sequentially
+func (l *recordLoaderImpl) UseIndex(index *recordIndex) {
+
+	l.indexed.stop()
+	l.indexed = nil
+	l.index = index
+}
+
+// can we index this file
+func (l *recordLoaderImpl) indexable() bool {
+	return l.parseWorkers > 1 && l.format == recordFormatMarc && l.input != nil && l.input.open != nil
+}
+
+// start the parsers, they each have their own handle on the file
+func (l *recordLoaderImpl) startIndexed() error {
+
+	l.indexed.stop()
+	l.indexed = nil
+
+	body, err := l.input.open()
+	if err != nil {
+		return err
+	}
+	file, ok := body.(io.ReaderAt)
+	if ok == false {
+		body.Close()
+		return ErrNotRewindable
+	}
+
+	r := &indexedReader{
+		ordered: make(chan chan indexedBatch, l.parseWorkers*indexReadAhead),
+		quit:    make(chan struct{}),
+	}
+	jobs := make(chan indexedJob, l.parseWorkers)
+
+	// hand out the records in file order, the result channels are queued in the same order
+	go func() {
+		defer close(jobs)
+		defer close(r.ordered)
+		entries := l.index.entries
+		for len(entries) != 0 {
+			size := indexBatchSize
+			if size > len(entries) {
+				size = len(entries)
+			}
+			job := indexedJob{entries: entries[0:size], result: make(chan indexedBatch, 1)}
+			entries = entries[size:]
+
+			select {
+			case r.ordered <- job.result:
+			case <-r.quit:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < l.parseWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				recs, err := l.loadIndexed(file, job.entries)
+				job.result <- indexedBatch{recs: recs, err: err}
+			}
+		}()
+	}
+
+	// the file is closed once the parsers have finished
+	go func() {
+		wg.Wait()
+		body.Close()
+	}()
+
+	l.indexed = r
+	return nil
+}
+
+// load, merge and parse a run of indexed records, they are read from the file in one go
+func (l *recordLoaderImpl) loadIndexed(file io.ReaderAt, entries []recordIndexEntry) ([]Record, error) {
+
+	first := entries[0].segments[0]
+	last := entries[len(entries)-1].segments[len(entries[len(entries)-1].segments)-1]
+	buf := make([]byte, last.offset+int64(last.length)-first.offset)
+	n, err := file.ReadAt(buf, first.offset)
+	if n != len(buf) {
+		if err == nil || err == io.EOF {
+			err = ErrIndexMismatch
+		}
+		return nil, err
+	}
+
+	recs := make([]Record, 0, len(entries))
+	for _, entry := range entries {
+		rec, err := l.loadIndexedRecord(buf, first.offset, entry)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// merge and parse an indexed record from the buffer, which begins at the specified file offset
+func (l *recordLoaderImpl) loadIndexedRecord(buf []byte, offset int64, entry recordIndexEntry) (Record, error) {
+
+	var rec Record
+	for _, segment := range entry.segments {
+
+		start := segment.offset - offset
+		raw := buf[start : start+int64(segment.length) : start+int64(segment.length)]
+		next, err := l.prepareRecord(&recordImpl{RawBytes: raw, source: l.DataSource, format: recordFormatMarc, offset: segment.offset})
+		if err != nil {
+			return nil, err
+		}
+
+		if rec == nil {
+			rec = next
+			continue
+		}
+		rec, err = mergeRecords(l.config, rec, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the record is parsed here so nothing else needs to
+	id, err := rec.Id()
+	if err != nil {
+		return nil, err
+	}
+	if id != entry.id {
+		return nil, fmt.Errorf("%w: expected %s, found %s", ErrIndexMismatch, entry.id, id)
+	}
+	return rec, nil
+}
+
+// the next record in file order, io.EOF when there are no more
+func (r *indexedReader) next() (Record, error) {
+
+	if len(r.current) == 0 {
+		result, ok := <-r.ordered
+		if ok == false {
+			return nil, io.EOF
+		}
+		batch := <-result
+		if batch.err != nil {
+			return nil, batch.err
+		}
+		r.current = batch.recs
+	}
+
+	rec := r.current[0]
+	r.current = r.current[1:]
+	return rec, nil
+}
+
+func (r *indexedReader) stop() {
+	if r != nil {
+		close(r.quit)
+	}
+}
+
+//
+// end of file
+//
@@ -2,10 +2,11 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -13,6 +14,36 @@ import (
 // ErrBadRecord - a bad record encountered
 var ErrBadRecord = fmt.Errorf("bad MARC record encountered")
 
+// a bad record error with additional detail
+func badRecordError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrBadRecord, reason)
+}
+
+// a record level error, the reader has moved past the bad record and can continue with the next one
+type recordError struct {
+	offset int64  // the byte offset of the record within the file (approximate for some formats)
+	reason string // what was wrong with it
+	raw    []byte // the raw record, if available
+}
+
+func newRecordError(offset int64, reason string, raw []byte) error {
+	return &recordError{offset: offset, reason: reason, raw: raw}
+}
+
+func (e *recordError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrBadRecord.Error(), e.reason)
+}
+
+func (e *recordError) Unwrap() error {
+	return ErrBadRecord
+}
+
+// ErrRecordTooLarge - a record cannot be represented in ISO 2709 form
+var ErrRecordTooLarge = fmt.Errorf("MARC record is too large")
+
+// ErrNotMarcRecord - the record has no MARC content
+var ErrNotMarcRecord = fmt.Errorf("record has no MARC content")
+
 // ErrFileNotOpen - file is not open
 var ErrFileNotOpen = fmt.Errorf("file is not open")
 
@@ -22,60 +53,242 @@ type RecordLoader interface {
 	Validate() error
 	First(bool) (Record, error)
 	Next(bool) (Record, error)
+	BadRecords() []BadRecord
+	Records() int // the number of records found by Validate
+	TrackDuplicates(*duplicateTracker)
+	Index() *recordIndex
+	UseIndex(*recordIndex)
 	Done()
 }
 
+// BadRecord - details of a record that was skipped because it could not be loaded
+type BadRecord struct {
+	Offset int64  `json:"offset"` // the byte offset of the record within the file
+	Length int64  `json:"length"` // the number of bytes skipped
+	Reason string `json:"reason"` // why the record was skipped
+	Raw    []byte `json:"raw"`    // the skipped bytes (may be truncated)
+}
+
 // Record - the record interface
 type Record interface {
 	Id() (string, error)
 	Source() string
 	SetSource(string)
 	Raw() []byte
+	Format() string       // the format the record was loaded from
+	Xml() ([]byte, error) // the record as MARCXML
+	Deleted() bool        // the record is marked as deleted and the data source says we should honor it
+
+	Delivery() *recordDelivery   // confirms delivery of the record (optional)
+	SetDelivery(*recordDelivery) // ...
+
+	Leader() string                    // the record leader, blank if the record cannot be parsed
+	Fields(string) []MarcField         // all fields with the specified tag (all fields if blank)
+	Subfields(string, string) []string // all values of the specified subfield code within the specified tag
+}
+
+// the interface implemented by each of the supported input formats
+type recordReader interface {
+	rewind() error         // position at the start of the input
+	read() (Record, error) // read the next record, io.EOF when there are no more
+	close()                // release any resources
+}
+
+// implemented by readers that can skip over corrupt records
+type recoveringReader interface {
+	badRecords() []BadRecord
 }
 
 // this is our loader implementation
 type recordLoaderImpl struct {
-	DataSource string   // determined from the filename
-	File       *os.File // our file handle
-	HeaderBuff []byte   // buffer for the record header
+	DataSource string       // determined from the filename
+	name       string       // the remote file name
+	format     string       // the input format
+	input      *inputStream // the input, the index is read from another handle on the same file
+	reader     recordReader // the format specific reader
+	pending    Record       // a record that has been read ahead but not yet returned
+	pendingErr error        // an error encountered during read ahead but not yet returned
+
+	transcoder *marc8Transcoder // used to convert MARC-8 records to UTF-8 (optional)
+
+	tolerant  bool        // skip bad records rather than failing
+	rejected  []BadRecord // the bad records we have skipped
+	validated int         // the number of records found by Validate
+
+	idRules      []IdRule      // how we locate the record id for this data source
+	honorDeletes bool          // does this data source mark deleted records reliably
+	config       ServiceConfig // the configuration, used when merging records
+
+	duplicates *duplicateTracker // notes record ids across the batch during validation (optional)
+
+	parseWorkers int            // the number of goroutines parsing indexed records
+	index        *recordIndex   // the record index built during validation (optional)
+	indexed      *indexedReader // reads the records in the index in parallel (when in use)
 }
 
 // this is our record implementation
 type recordImpl struct {
-	RawBytes []byte // the raw record
-	source   string // determined from the filename
-	marcId   string // extracted from the record
-}
+	RawBytes []byte   // the raw record
+	source   string   // determined from the filename
+	marcId   string   // extracted from the record
+	format   string   // the format the record was loaded from
+	offset   int64    // the byte offset of the record within the file (approximate for some formats)
+	idRules  []IdRule // how we locate the record id
 
-//
-// This implementation based on the MARC reader code here:
-//
-// https://github.com/marc4j/marc4j/blob/master/src/org/marc4j/util/RawRecord.java
-// https://github.com/marc4j/marc4j/blob/master/src/org/marc4j/util/RawRecordReader.java
-//
-// All errors in the implementation are mine :)
-//
+	honorDeletes bool // a deleted record status means the record is deleted
+
+	segments []recordSegment // where the record came from, continuation records add more
+
+	delivery *recordDelivery // confirms delivery of the record (optional)
+
+	parsed   *marcRecord // the parsed record, populated on demand
+	parseErr error       // the error encountered parsing the record, if any
+}
 
 // the size of the MARC record header
 var marcRecordHeaderSize = 5
 var marcRecordFieldDirStart = 24
 var marcRecordFieldDirEntrySize = 12
 
+// the leader record status (position 05) of a deleted record
+var marcRecordStatusDeleted = byte('d')
+
 // terminator sentinel values
 var fieldTerminator = byte(0x1e)
 var recordTerminator = byte(0x1d)
 
+// the supported input formats
+var recordFormatMarc = "marc"
+var recordFormatXml = "marcxml"
+var recordFormatJson = "marcjson"
+var recordFormatMnemonic = "mrk"
+var recordFormatDeleteList = "deletes"
+
+// the number of bytes we look at when trying to identify the input format
+var formatSniffSize = 512
+
 // NewRecordLoader - the factory
-func NewRecordLoader(defaultDataSource string, remoteName string, localName string) (RecordLoader, error) {
+func NewRecordLoader(config ServiceConfig, remoteName string, localName string) (RecordLoader, error) {
+
+	input, err := newFileInputStream(localName)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamRecordLoader(config, remoteName, input)
+}
+
+// create a record loader that reads from the supplied input stream
+func newStreamRecordLoader(config ServiceConfig, remoteName string, input *inputStream) (RecordLoader, error) {
+
+	var transcoder *marc8Transcoder
+	if config.Marc8Transcode == true {
+		t, err := getMarc8Transcoder(config.Marc8CodeTables)
+		if err != nil {
+			input.close()
+			return nil, err
+		}
+		transcoder = t
+	}
+
+	// delete lists are identified by name, they have no recognizable content
+	format := recordFormatDeleteList
+	if matchesFileName(config.DeleteListPatterns, remoteName) == false {
+		f, err := detectFormat(input, remoteName)
+		if err != nil {
+			input.close()
+			return nil, err
+		}
+		format = f
+	}
 
-	file, err := os.Open(localName)
+	source := getDataSource(config.DataSource, remoteName)
+	tolerant := config.ErrorPolicy == errorPolicyQuarantine
+	log.Printf("INFO: %s identified as %s format", remoteName, format)
+
+	// the data source configuration is determined by the configured data source if there is one
+	effectiveSource := source
+	if config.DataSource != "" {
+		effectiveSource = config.DataSource
+	}
+	sourceConfig := config.SourceConfigs.forSource(effectiveSource)
+
+	var reader recordReader
+	switch format {
+	case recordFormatXml:
+		reader = newMarcXmlReader(input, source)
+	case recordFormatJson:
+		reader = newMarcJsonReader(input, source)
+	case recordFormatMnemonic:
+		reader = newMarcMnemonicReader(input, source)
+	case recordFormatDeleteList:
+		reader = newDeleteListReader(input, source, sourceConfig.DeleteIdPrefix)
+	default:
+		reader = newMarcBinaryReader(input, source, config.RecoverBadRecords || tolerant)
+	}
+
+	return &recordLoaderImpl{DataSource: source, name: remoteName, format: format, input: input, reader: reader, transcoder: transcoder,
+		tolerant: tolerant, idRules: sourceConfig.IdRules, honorDeletes: sourceConfig.HonorDeletes, config: config,
+		parseWorkers: config.ParseWorkers}, nil
+}
+
+// make a new record from a parsed one, the raw form is generated from the parsed form
+func newRecordFromParsed(parsed *marcRecord, source string, format string) (Record, error) {
+
+	raw, err := parsed.marshal()
 	if err != nil {
 		return nil, err
 	}
 
-	source := getDataSource(defaultDataSource, remoteName)
-	buf := make([]byte, marcRecordHeaderSize)
-	return &recordLoaderImpl{File: file, DataSource: source, HeaderBuff: buf}, nil
+	// the leader now reflects the serialized record
+	parsed.leader = string(raw[0:marcRecordLeaderSize])
+	return &recordImpl{RawBytes: raw, source: source, format: format, parsed: parsed}, nil
+}
+
+// identify the input format from the file contents or, if they are inconclusive, the file name
+func detectFormat(input *inputStream, name string) (string, error) {
+
+	// we only peek, the reader will need the content too
+	buf, err := input.peek(formatSniffSize)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	// ignore any byte order mark and leading whitespace
+	content := bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf"))
+	content = bytes.TrimLeft(content, " \t\r\n")
+	if len(content) != 0 {
+		if content[0] == '<' {
+			return recordFormatXml, nil
+		}
+
+		if content[0] == '{' || content[0] == '[' {
+			return recordFormatJson, nil
+		}
+
+		if bytes.HasPrefix(content, []byte("=LDR")) {
+			return recordFormatMnemonic, nil
+		}
+
+		// binary MARC always begins with the 5 digit record length
+		if len(content) >= marcRecordHeaderSize {
+			if _, err := strconv.Atoi(string(content[0:marcRecordHeaderSize])); err == nil {
+				return recordFormatMarc, nil
+			}
+		}
+	}
+
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".xml"):
+		return recordFormatXml, nil
+	case strings.HasSuffix(lower, ".json"), strings.HasSuffix(lower, ".jsonl"), strings.HasSuffix(lower, ".ndjson"):
+		return recordFormatJson, nil
+	case strings.HasSuffix(lower, ".mrk"):
+		return recordFormatMnemonic, nil
+	}
+
+	return recordFormatMarc, nil
 }
 
 func getDataSource(defaultDataSource string, name string) string {
@@ -105,12 +318,20 @@ func getDataSource(defaultDataSource string, name string) string {
 // read all the records to ensure the file is valid
 func (l *recordLoaderImpl) Validate() error {
 
-	if l.File == nil {
+	if l.reader == nil {
 		return ErrFileNotOpen
 	}
 
-	// get the first record and error out if bad. An EOF is OK, just means the file is empty
-	_, err := l.First(false)
+	// we build an index as we go so the records can be parsed in parallel when they are ingested
+	l.UseIndex(nil)
+	var index *recordIndex
+	if l.indexable() == true {
+		index = &recordIndex{}
+	}
+
+	// get the first record and error out if bad. An EOF is OK, just means the file is empty. We read ahead
+	// in the same way as ingest so any problems merging records are found now
+	rec, err := l.First(true)
 	if err != nil {
 		// are we done
 		if err == io.EOF {
@@ -123,11 +344,19 @@ func (l *recordLoaderImpl) Validate() error {
 	}
 
 	// used for reporting
-	recordIndex := 1
+	recordIndex := 0
 
 	// read all the records and bail on the first failure except EOF
 	for {
-		_, err = l.Next(false)
+		err = l.noteDuplicate(recordIndex, rec)
+		if err != nil {
+			log.Printf("ERROR: validation failure on record index %d", recordIndex)
+			return err
+		}
+		recordIndex++
+		index.add(rec)
+
+		rec, err = l.Next(true)
 
 		if err != nil {
 			// are we done
@@ -138,7 +367,22 @@ func (l *recordLoaderImpl) Validate() error {
 				return err
 			}
 		}
-		recordIndex++
+	}
+
+	l.validated = recordIndex
+
+	if count := l.duplicates.duplicates(l.name); count != 0 {
+		log.Printf("WARNING: %s contains %d duplicate record id(s)", l.name, count)
+	}
+
+	// report anything we skipped
+	for _, bad := range l.BadRecords() {
+		log.Printf("WARNING: bad record skipped at offset %d (%d bytes): %s", bad.Offset, bad.Length, bad.Reason)
+	}
+
+	if index != nil {
+		index.badRecords = l.BadRecords()
+		l.UseIndex(index)
 	}
 
 	// everything is OK
@@ -147,12 +391,24 @@ func (l *recordLoaderImpl) Validate() error {
 
 func (l *recordLoaderImpl) First(readAhead bool) (Record, error) {
 
-	if l.File == nil {
+	if l.reader == nil {
 		return nil, ErrFileNotOpen
 	}
 
-	// go to the start of the file and then get the next record
-	_, err := l.File.Seek(0, 0)
+	// the index only describes records that have been read ahead
+	if l.index != nil && readAhead == true {
+		err := l.startIndexed()
+		if err != nil {
+			return nil, err
+		}
+		return l.Next(readAhead)
+	}
+
+	// discard anything we have read ahead, go to the start of the file and then get the next record
+	l.pending = nil
+	l.pendingErr = nil
+	l.rejected = nil
+	err := l.reader.rewind()
 	if err != nil {
 		return nil, err
 	}
@@ -162,16 +418,15 @@ func (l *recordLoaderImpl) First(readAhead bool) (Record, error) {
 
 func (l *recordLoaderImpl) Next(readAhead bool) (Record, error) {
 
-	if l.File == nil {
+	if l.reader == nil {
 		return nil, ErrFileNotOpen
 	}
 
-	rec, err := l.rawMarcRead()
-	if err != nil {
-		return nil, err
+	if l.indexed != nil {
+		return l.indexed.next()
 	}
 
-	id, err := rec.Id()
+	rec, id, err := l.readIdentifiedRecord()
 	if err != nil {
 		return nil, err
 	}
@@ -185,42 +440,36 @@ func (l *recordLoaderImpl) Next(readAhead bool) (Record, error) {
 	if readAhead == true {
 
 		for {
-			// get the current position, assume no error cos we are not moving the file pointer
-			currentPos, _ := l.File.Seek(0, 1)
-
 			// get the next record
-			nextRec, err := l.rawMarcRead()
-			if err != nil {
-
-				// if we error move the file pointer back and return the previously read record without error
-				_, _ = l.File.Seek(currentPos, 0)
-				return rec, nil
-			}
-
-			nextId, err := nextRec.Id()
+			nextRec, nextId, err := l.readIdentifiedRecord()
 			if err != nil {
-				// if we error move the file pointer back and return the previously read record without error
-				_, _ = l.File.Seek(currentPos, 0)
+				// if we error keep the error for the next read and return the previously read record without error
+				l.pendingErr = err
 				return rec, nil
 			}
 
 			if id != nextId {
-				// if the id's do not match move the file pointer back and return the previously read record
-				_, _ = l.File.Seek(currentPos, 0)
+				// if the id's do not match keep the record for the next read and return the previously read record
+				l.pending = nextRec
 				return rec, nil
 			}
 
-			// the id's match so we should append the contents of the next record onto the contents of the previous record
-			// and repeat the process
-			impl, ok := rec.(*recordImpl)
-			if ok == true {
-				log.Printf("INFO: identified additional marc record for %s, appending it", id)
-				impl.RawBytes = append(rec.Raw(), nextRec.Raw()...)
-			} else {
-				log.Printf("ERROR: unable to append MARC additional record")
-				_, _ = l.File.Seek(currentPos, 0)
-				return rec, nil
+			// the id's match so we should merge the next record into the previous record and repeat the process
+			log.Printf("INFO: identified additional marc record for %s, merging it", id)
+			merged, err := mergeRecords(l.config, rec, nextRec)
+			if err != nil {
+				var recErr *recordError
+				if l.tolerant == false || errors.As(err, &recErr) == false {
+					return nil, err
+				}
+
+				// skip the record and any further continuation records and carry on with the next one
+				l.reject(recErr.offset, recErr.reason, rec.Raw())
+				l.skipContinuations(id)
+				return l.Next(readAhead)
 			}
+			merged.(*recordImpl).segments = append(rec.(*recordImpl).segments, nextRec.(*recordImpl).segments...)
+			rec = merged
 		}
 	}
 
@@ -229,100 +478,157 @@ func (l *recordLoaderImpl) Next(readAhead bool) (Record, error) {
 
 func (l *recordLoaderImpl) Done() {
 
-	if l.File != nil {
-		l.File.Close()
-		l.File = nil
+	l.indexed.stop()
+	l.indexed = nil
+
+	if l.reader != nil {
+		l.reader.close()
+		l.reader = nil
 	}
 }
 
+func (l *recordLoaderImpl) BadRecords() []BadRecord {
+
+	// we do not read the file again when using an index, the bad records were found during validation
+	if l.index != nil {
+		return append(make([]BadRecord, 0, len(l.index.badRecords)), l.index.badRecords...)
+	}
+
+	bad := make([]BadRecord, 0, len(l.rejected))
+	if rr, ok := l.reader.(recoveringReader); ok == true {
+		bad = append(bad, rr.badRecords()...)
+	}
+	bad = append(bad, l.rejected...)
+
+	// report them in file order
+	sort.SliceStable(bad, func(i, j int) bool { return bad[i].Offset < bad[j].Offset })
+	return bad
+}
+
+func (l *recordLoaderImpl) Records() int {
+	return l.validated
+}
+
 func (l *recordLoaderImpl) Source() string {
 	return l.DataSource
 }
 
-func (l *recordLoaderImpl) rawMarcRead() (Record, error) {
+func (l *recordLoaderImpl) TrackDuplicates(duplicates *duplicateTracker) {
+	l.duplicates = duplicates
+}
 
-	// read the 5 byte length header
-	_, err := l.File.Read(l.HeaderBuff)
-	if err != nil {
-		return nil, err
-	}
+// note the record id for duplicate detection, duplicates are errors (or bad records) if we are rejecting them
+func (l *recordLoaderImpl) noteDuplicate(index int, rec Record) error {
 
-	// is it potentially a record length?
-	length, err := strconv.Atoi(string(l.HeaderBuff))
-	if err != nil {
-		return nil, err
+	id, _ := rec.Id()
+	if l.duplicates.note(l.name, index, id) == false || l.config.DuplicatePolicy != duplicateReject {
+		return nil
 	}
 
-	// ensure the number is sane
-	if length <= marcRecordHeaderSize {
-		log.Printf("ERROR: marc record prefix invalid (%s)", string(l.HeaderBuff))
-		return nil, ErrBadRecord
+	if l.tolerant == false {
+		return fmt.Errorf("%w: %s", ErrDuplicateRecord, id)
 	}
+	l.reject(rec.(*recordImpl).offset, fmt.Sprintf("duplicate record id %s", id), rec.Raw())
+	return nil
+}
 
-	// we need to include the header in the raw record so move back so we read it again
-	_, err = l.File.Seek(int64(-marcRecordHeaderSize), 1)
-	if err != nil {
-		return nil, err
-	}
+// get the next record that has an id. If we are tolerant of bad records, they are noted and skipped
+func (l *recordLoaderImpl) readIdentifiedRecord() (Record, string, error) {
 
-	readBuf := make([]byte, length)
-	readBytes, err := l.File.Read(readBuf)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		rec, err := l.readRecord()
+		if err != nil {
+			var recErr *recordError
+			if l.tolerant == true && errors.As(err, &recErr) == true {
+				l.reject(recErr.offset, recErr.reason, recErr.raw)
+				continue
+			}
+			return nil, "", err
+		}
 
-	// we did not read the number of bytes we expected, log it and declare victory
-	if readBytes != length {
-		log.Printf("WARNING: short record read. Expected %d, got %d. Declaring EOF", length, readBytes)
-		return nil, io.EOF
+		id, err := rec.Id()
+		if err != nil {
+			if l.tolerant == true {
+				l.reject(rec.(*recordImpl).offset, fmt.Sprintf("cannot determine record id (%s)", err.Error()), rec.Raw())
+				continue
+			}
+			return nil, "", err
+		}
+
+		return rec, id, nil
 	}
+}
 
-	// verify the end of record marker exists and return success if it does
-	if readBuf[length-2] == fieldTerminator && readBuf[length-1] == recordTerminator {
-		return &recordImpl{RawBytes: readBuf, source: l.DataSource}, nil
+// skip any records with the specified id, the first record with a different id (or error) is kept for the next read
+func (l *recordLoaderImpl) skipContinuations(id string) {
+
+	for {
+		rec, nextId, err := l.readIdentifiedRecord()
+		if err != nil {
+			l.pendingErr = err
+			return
+		}
+		if nextId != id {
+			l.pending = rec
+			return
+		}
+		log.Printf("WARNING: skipping additional marc record for %s", id)
 	}
+}
 
-	log.Printf("WARNING: unexpected marc record suffix. Expected (%x %x) got (%x %x). Header length reports %d", fieldTerminator, recordTerminator, readBuf[length-2], readBuf[length-1], length)
+// note a bad record that we are skipping
+func (l *recordLoaderImpl) reject(offset int64, reason string, raw []byte) {
+	log.Printf("WARNING: skipping bad record at offset %d (%s)", offset, reason)
+	l.rejected = append(l.rejected, BadRecord{Offset: offset, Length: int64(len(raw)), Reason: reason, Raw: raw})
+}
 
-	//
-	// we have a badly formed record, look to see if the terminator appears earlier in the record (in bytes we have already read)
-	//
+// get the next record, either one we have already read ahead or a new one from the reader
+func (l *recordLoaderImpl) readRecord() (Record, error) {
 
-	tag := []byte{fieldTerminator, recordTerminator}
-	foundIx := bytes.Index(readBuf, tag)
-	if foundIx != -1 {
-		log.Printf("WARNING: located record terminator earlier in the buffer at offset %d", foundIx)
-		// FIXME: we need to reset the file pointer
-		log.Printf("ERROR: WE HAVE NOT RESET THE FILE POINTER, SUBSEQUENT READS WILL BE BAD")
-		return &recordImpl{RawBytes: readBuf[0:foundIx], source: l.DataSource}, nil
+	if l.pending != nil {
+		rec := l.pending
+		l.pending = nil
+		return rec, nil
 	}
 
-	//
-	// we did not find the record terminator in the buffer we have already read,
-	// now look to see if it appears later (because this is a record larger than 5 digits)
-	// hate how Hathi does this, should probably follow the Sirsi model instead
-	//
+	if l.pendingErr != nil {
+		err := l.pendingErr
+		l.pendingErr = nil
+		return nil, err
+	}
 
-	additionalBuffer := make([]byte, 0, 128*1024)
-	for {
-		b := make([]byte, 1)
-		_, err = l.File.Read(b)
-		if err != nil {
-			log.Printf("ERROR: reading forward for record terminator, giving up (%s)", err.Error())
-			break
-		}
+	rec, err := l.reader.read()
+	if err != nil {
+		return nil, err
+	}
 
-		additionalBuffer = append(additionalBuffer, b...)
+	return l.prepareRecord(rec)
+}
 
-		// did we find the record terminator
-		if b[0] == recordTerminator {
-			log.Printf("WARNING: record terminator located after an additional %d bytes", len(additionalBuffer))
-			return &recordImpl{RawBytes: append(readBuf, additionalBuffer...), source: l.DataSource}, nil
+// prepare a record that has just been read for use, it is converted to UTF-8 if necessary
+func (l *recordLoaderImpl) prepareRecord(rec Record) (Record, error) {
+
+	impl := rec.(*recordImpl)
+	segment := recordSegment{offset: impl.offset, length: len(impl.RawBytes)}
+
+	// a blank character coding scheme indicates MARC-8
+	if l.transcoder != nil {
+		leader := rec.Leader()
+		if len(leader) == marcRecordLeaderSize && leader[9] == ' ' {
+			converted, err := l.transcoder.transcodeRecord(rec)
+			if err != nil {
+				return nil, newRecordError(impl.offset, err.Error(), rec.Raw())
+			}
+			converted.(*recordImpl).offset = impl.offset
+			rec = converted
 		}
 	}
 
-	//log.Printf("FIXME: %s", string(readBuf))
-	return nil, ErrBadRecord
+	rec.(*recordImpl).idRules = l.idRules
+	rec.(*recordImpl).honorDeletes = l.honorDeletes
+	rec.(*recordImpl).segments = []recordSegment{segment}
+
+	return rec, nil
 }
 
 func (r *recordImpl) Id() (string, error) {
@@ -346,89 +652,110 @@ func (r *recordImpl) SetSource(source string) {
 	r.source = source
 }
 
-func (r *recordImpl) extractId() (string, error) {
+func (r *recordImpl) Format() string {
+	return r.format
+}
+
+func (r *recordImpl) Delivery() *recordDelivery {
+	return r.delivery
+}
+
+func (r *recordImpl) SetDelivery(delivery *recordDelivery) {
+	r.delivery = delivery
+}
+
+func (r *recordImpl) Xml() ([]byte, error) {
 
-	id, err := r.getMarcFieldId("001")
+	parsed, err := r.parse()
 	if err != nil {
-		id, err = r.getMarcFieldId("035")
+		return nil, err
 	}
+	return parsed.marshalXml()
+}
 
-	if err != nil {
-		return "", err
+func (r *recordImpl) Deleted() bool {
+
+	// everything in a delete list is deleted
+	if r.format == recordFormatDeleteList {
+		return true
+	}
+
+	if r.honorDeletes == false {
+		return false
 	}
 
-	// ensure the first character of the Id us a 'u' character
-	//if id[0] != 'u' {
-	//	log.Printf("ERROR: marc record id is suspect (%s)", id)
-	//	return "", BadRecordIdError
-	//}
+	leader := r.Leader()
+	return len(leader) == marcRecordLeaderSize && leader[5] == marcRecordStatusDeleted
+}
 
-	r.marcId = id
+func (r *recordImpl) Leader() string {
 
-	//log.Printf( "ID: %s", r.marcId )
-	return r.marcId, nil
+	parsed, err := r.parse()
+	if err != nil {
+		return ""
+	}
+	return parsed.leader
 }
 
-//
-// A marc record consists of a 5 byte length header (in ascii) followed by a 'directory' of fields.
-// The offset of the end of the directory is specified at byte 12 for 5 bytes.
-// All field descriptors within the directory consist of the following:
-//    field Id (string) bytes 0 - 2 (3 bytes)
-//    field length (string) bytes 3 - 6 (4 bytes)
-//    field offset (string) bytes 7 - 11 (5 bytes)
-//
-// The actual field values begin after the end of the directory.
-//
+func (r *recordImpl) Fields(tag string) []MarcField {
 
-func (r *recordImpl) getMarcFieldId(fieldId string) (string, error) {
+	parsed, err := r.parse()
+	if err != nil {
+		return make([]MarcField, 0)
+	}
+	return parsed.getFields(tag)
+}
 
-	currentOffset := marcRecordFieldDirStart
-	endOfDir, err := strconv.Atoi(string(r.RawBytes[12:17]))
+func (r *recordImpl) Subfields(tag string, code string) []string {
+
+	parsed, err := r.parse()
 	if err != nil {
-		log.Printf("ERROR: marc record end of directory offset invalid (%s)", string(r.RawBytes[12:17]))
-		return "", ErrBadRecord
+		return make([]string, 0)
 	}
+	return parsed.getSubfields(tag, code)
+}
 
-	// make sure we are actually pointing where we expect
-	if endOfDir == 99999 || r.RawBytes[endOfDir-1 : endOfDir][0] != fieldTerminator {
-		tag := []byte{fieldTerminator}
-		foundIx := bytes.Index(r.RawBytes, tag)
-		if foundIx == -1 {
-			log.Printf("ERROR: cannot locate end of directory marker")
-			return "", ErrBadRecord
-		}
-		foundIx++
-		log.Printf("INFO: resetting directory terminator. was %d, now %d", endOfDir, foundIx)
-		endOfDir = foundIx
+// parse the raw record the first time it is required
+func (r *recordImpl) parse() (*marcRecord, error) {
+
+	// delete list entries are just an id
+	if r.format == recordFormatDeleteList {
+		return nil, ErrNotMarcRecord
 	}
 
-	for currentOffset < endOfDir {
-		dirEntry := r.RawBytes[currentOffset : currentOffset+marcRecordFieldDirEntrySize]
-		//log.Printf( "Dir entry [%s]", string( dirEntry ) )
-		fieldNumber := string(dirEntry[0:3])
-		next := string(dirEntry[3:7])
-		fieldLength, err := strconv.Atoi(next)
-		if err != nil {
-			log.Printf("ERROR: marc record field length invalid (%s)", next)
-			return "", ErrBadRecord
-		}
-		next = string(dirEntry[7:12])
-		fieldOffset, err := strconv.Atoi(next)
-		if err != nil {
-			log.Printf("ERROR: marc record field offset invalid (%s)", next)
-			return "", ErrBadRecord
-		}
+	if r.parsed == nil && r.parseErr == nil {
+		r.parsed, r.parseErr = parseMarcRecord(r.RawBytes)
+	}
+	return r.parsed, r.parseErr
+}
 
-		//log.Printf( "Found field number %s. Offset %d, Length %d", fieldNumber, fieldOffset, fieldLength )
-		if fieldNumber == fieldId {
-			fieldStart := endOfDir + fieldOffset
-			return string(r.RawBytes[fieldStart : fieldStart+fieldLength-1]), nil
+func (r *recordImpl) extractId() (string, error) {
+
+	parsed, err := r.parse()
+	if err != nil {
+		return "", err
+	}
+
+	rules := r.idRules
+	if len(rules) == 0 {
+		rules = defaultIdRules
+	}
+
+	// the first rule that matches wins
+	for _, rule := range rules {
+		if id, ok := rule.apply(parsed); ok == true {
+			r.marcId = id
+			//log.Printf( "ID: %s", r.marcId )
+			return r.marcId, nil
 		}
-		currentOffset += marcRecordFieldDirEntrySize
 	}
 
-	log.Printf("ERROR: could not locate field %s in marc record", fieldId)
-	return "", ErrBadRecord
+	tried := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		tried = append(tried, rule.String())
+	}
+	log.Printf("ERROR: could not locate an id in marc record (tried %s)", strings.Join(tried, ", "))
+	return "", fmt.Errorf("%w: %s (tried %s)", ErrBadRecord, ErrNoIdRuleMatched.Error(), strings.Join(tried, ", "))
 }
 
 //
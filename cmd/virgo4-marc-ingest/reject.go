@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+// the supported error policies
+var errorPolicyRejectBatch = "reject-batch" // any invalid file rejects every file in the notification (the original behavior)
+var errorPolicyRejectFile = "reject-file"   // an invalid file is rejected, the remaining files are processed
+var errorPolicyQuarantine = "quarantine"    // bad records are skipped and reported, the good ones are processed
+
+// ErrTooManyBadRecords - the file contains more bad records than we are prepared to tolerate
+var ErrTooManyBadRecords = fmt.Errorf("too many bad records")
+
+// RejectReport - the report written when a file is rejected or records are quarantined
+type RejectReport struct {
+	File       string      `json:"file"`        // the remote file name (bucket/key)
+	Policy     string      `json:"policy"`      // the error policy in effect
+	Rejected   bool        `json:"rejected"`    // was the entire file rejected
+	Reason     string      `json:"reason"`      // why the file was rejected (if it was)
+	BadRecords []BadRecord `json:"bad_records"` // the bad records
+	Timestamp  time.Time   `json:"timestamp"`   // when the report was generated
+}
+
+// write the reject report for the specified file to the configured bucket. If no bucket is configured, the
+// report is logged only
+func writeRejectReport(cfg ServiceConfig, s3Svc uva_s3.UvaS3, report RejectReport) error {
+
+	report.Policy = cfg.ErrorPolicy
+	report.Timestamp = time.Now()
+	if report.BadRecords == nil {
+		report.BadRecords = make([]BadRecord, 0)
+	}
+
+	if report.Rejected == true {
+		log.Printf("WARNING: %s rejected (%s), %d bad record(s)", report.File, report.Reason, len(report.BadRecords))
+	} else {
+		log.Printf("WARNING: %s quarantined %d bad record(s)", report.File, len(report.BadRecords))
+	}
+
+	return putReport(cfg, s3Svc, report.File, "rejects", report)
+}
+
+// write a validation report for the specified file to the configured bucket. If no bucket is configured, the
+// report is not written
+func writeValidationReport(cfg ServiceConfig, s3Svc uva_s3.UvaS3, report *ValidationReport) error {
+	return putReport(cfg, s3Svc, report.File, "validation", report)
+}
+
+// write a JSON report about the specified file to the configured bucket
+func putReport(cfg ServiceConfig, s3Svc uva_s3.UvaS3, remoteName string, kind string, report interface{}) error {
+
+	if cfg.RejectBucket == "" {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the remote file name includes the source bucket, we only want the key
+	key := remoteName
+	if ix := strings.Index(key, "/"); ix != -1 {
+		key = key[ix+1:]
+	}
+	key = path.Join(cfg.RejectPrefix, fmt.Sprintf("%s.%s.json", key, kind))
+
+	log.Printf("INFO: writing %s report to s3://%s/%s", kind, cfg.RejectBucket, key)
+	o := uva_s3.NewUvaS3Object(cfg.RejectBucket, key)
+	return s3Svc.PutFromBuffer(o, buf)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+)
+
+//
+// Some configuration is specific to a data source. It is loaded from a JSON file which contains the default
+// configuration and any source specific overrides. For example:
+//
+// {
+//   "default": {
+//     "id_rules": [ { "tag": "001" }, { "tag": "035" } ]
+//   },
+//   "sources": {
+//     "hathi": {
+//       "id_rules": [ { "tag": "035", "subfield": "a", "strip": "^\\(OCoLC\\)0*" } ]
+//     },
+//     "sirsi": {
+//       "id_rules": [ { "tag": "001", "prefix": "u" }, { "tag": "999", "subfield": "c", "prefix": "u" } ],
+//       "honor_deletes": true,
+//       "delete_id_prefix": "u",
+//       "transforms": [ { "type": "strip_fields", "tags": [ "9XX" ] }, { "type": "add_ingest_field", "tag": "999" } ],
+//       "filters": [ { "name": "authority", "leader_position": 6, "values": "z" } ]
+//     }
+//   }
+// }
+//
+// Source specific sections replace the default section entirely (except for the id rules, transforms and filters
+// which are inherited from the default section if not specified).
+//
+// The supported transforms are:
+//   strip_fields     - remove the fields with the specified tags, X is a wildcard ("tags")
+//   add_ingest_field - add a field containing the data source ($a) and ingest timestamp ($b) ("tag", default 999)
+//   normalize_001    - remove anything matching an expression from the 001 field and ensure it has a prefix
+//                      ("strip", "prefix")
+//
+
+// SourceConfig - the configuration for a specific data source
+type SourceConfig struct {
+	IdRules        []IdRule `json:"id_rules"`         // how we determine the record id, the first rule that matches is used
+	HonorDeletes   bool     `json:"honor_deletes"`    // records with a deleted status (leader/05 = 'd') are sent as deletes
+	DeleteIdPrefix string   `json:"delete_id_prefix"` // added to the ids in delete lists that do not already have it (optional)
+
+	Transforms   []TransformConfig `json:"transforms"` // the changes made to each record before it is published, in order
+	transformers []Transformer     // the transformers created from the above
+
+	Filters []FilterRule `json:"filters"` // decide which records are published, see FilterRule
+}
+
+// IdRule - identifies where a record id is located
+type IdRule struct {
+	Tag      string `json:"tag"`      // the field tag
+	Subfield string `json:"subfield"` // the subfield code (data fields only), blank to use the entire field
+	Strip    string `json:"strip"`    // a regular expression, anything it matches is removed from the id (optional)
+	Prefix   string `json:"prefix"`   // the id must begin with this prefix (optional)
+
+	stripExpr *regexp.Regexp // the compiled form of the above
+}
+
+// the contents of the source configuration file
+type sourceConfigFile struct {
+	Default SourceConfig            `json:"default"`
+	Sources map[string]SourceConfig `json:"sources"`
+}
+
+// SourceConfigSet - the configuration for all data sources
+type SourceConfigSet struct {
+	defaultConfig SourceConfig
+	sources       map[string]SourceConfig
+}
+
+// ErrNoIdRuleMatched - none of the id rules located an id
+var ErrNoIdRuleMatched = fmt.Errorf("no id rule matched")
+
+// the id rules we use when none are configured, the original behavior
+var defaultIdRules = []IdRule{{Tag: "001"}, {Tag: "035"}}
+
+// load the source configuration from the specified file. If no file is specified, the defaults are used
+func loadSourceConfigs(filename string) (*SourceConfigSet, error) {
+
+	set := &SourceConfigSet{
+		defaultConfig: SourceConfig{IdRules: defaultIdRules},
+		sources:       make(map[string]SourceConfig),
+	}
+
+	if filename == "" {
+		return set, nil
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file sourceConfigFile
+	err = json.Unmarshal(buf, &file)
+	if err != nil {
+		log.Printf("ERROR: source configuration %s is invalid (%s)", filename, err.Error())
+		return nil, err
+	}
+
+	set.defaultConfig = file.Default
+	if len(set.defaultConfig.IdRules) == 0 {
+		set.defaultConfig.IdRules = defaultIdRules
+	}
+	err = set.defaultConfig.prepare("default")
+	if err != nil {
+		return nil, err
+	}
+
+	for name, sc := range file.Sources {
+		if len(sc.IdRules) == 0 {
+			sc.IdRules = set.defaultConfig.IdRules
+		}
+		if sc.Transforms == nil {
+			sc.Transforms = set.defaultConfig.Transforms
+		}
+		if sc.Filters == nil {
+			sc.Filters = set.defaultConfig.Filters
+		}
+		err = sc.prepare(name)
+		if err != nil {
+			return nil, err
+		}
+		set.sources[name] = sc
+	}
+
+	return set, nil
+}
+
+// get the configuration for the specified data source
+func (s *SourceConfigSet) forSource(source string) SourceConfig {
+
+	if s == nil {
+		return SourceConfig{IdRules: defaultIdRules}
+	}
+
+	if sc, ok := s.sources[source]; ok == true {
+		return sc
+	}
+	return s.defaultConfig
+}
+
+// validate the configuration and compile any expressions
+func (sc *SourceConfig) prepare(name string) error {
+
+	rules := make([]IdRule, 0, len(sc.IdRules))
+	for ix, rule := range sc.IdRules {
+		if len(rule.Tag) != 3 {
+			log.Printf("ERROR: source %s id rule %d tag is invalid (%s)", name, ix, rule.Tag)
+			return fmt.Errorf("source %s id rule %d tag is invalid", name, ix)
+		}
+
+		if rule.Strip != "" {
+			expr, err := regexp.Compile(rule.Strip)
+			if err != nil {
+				log.Printf("ERROR: source %s id rule %d strip expression is invalid (%s)", name, ix, err.Error())
+				return err
+			}
+			rule.stripExpr = expr
+		}
+		rules = append(rules, rule)
+	}
+
+	sc.IdRules = rules
+
+	// the first id rule says where the record ids normally come from
+	idTag := ""
+	if len(sc.IdRules) != 0 {
+		idTag = sc.IdRules[0].Tag
+	}
+
+	sc.transformers = make([]Transformer, 0, len(sc.Transforms))
+	for ix, tc := range sc.Transforms {
+		t, err := newTransformer(tc, idTag)
+		if err != nil {
+			log.Printf("ERROR: source %s transform %d is invalid (%s)", name, ix, err.Error())
+			return err
+		}
+		sc.transformers = append(sc.transformers, t)
+	}
+
+	filters := make([]FilterRule, 0, len(sc.Filters))
+	for ix, rule := range sc.Filters {
+		err := rule.prepare()
+		if err != nil {
+			log.Printf("ERROR: source %s filter %d is invalid (%s)", name, ix, err.Error())
+			return err
+		}
+		filters = append(filters, rule)
+	}
+	sc.Filters = filters
+
+	return nil
+}
+
+// apply the rule to the record, returns the id if the rule matches
+func (rule IdRule) apply(parsed *marcRecord) (string, bool) {
+
+	for _, f := range parsed.getFields(rule.Tag) {
+
+		var candidates []string
+		if f.IsControl() == true || rule.Subfield == "" {
+			candidates = []string{f.data()}
+		} else {
+			for _, sf := range f.Subfields {
+				if sf.Code == rule.Subfield {
+					candidates = append(candidates, sf.Value)
+				}
+			}
+		}
+
+		for _, id := range candidates {
+			if rule.stripExpr != nil {
+				id = rule.stripExpr.ReplaceAllString(id, "")
+			}
+			if strings.TrimSpace(id) == "" {
+				continue
+			}
+			if rule.Prefix != "" && strings.HasPrefix(id, rule.Prefix) == false {
+				continue
+			}
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+// describe the rule for reporting
+func (rule IdRule) String() string {
+	s := rule.Tag
+	if rule.Subfield != "" {
+		s += "$" + rule.Subfield
+	}
+	if rule.Prefix != "" {
+		s += fmt.Sprintf(" (prefix %s)", rule.Prefix)
+	}
+	return s
+}
+
+//
+// end of file
+//
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// maintain the local state store. For example:
+//
+//    virgo4-marc-ingest state clear -store /data/state.db
+//    virgo4-marc-ingest state rebuild -store /data/state.db -source sirsi -rules sources.json full-dump.mrc
+//    virgo4-marc-ingest state wipe -store /data/state.db
+//
+// Clearing forgets the state of every record so they are all published again. Rebuilding clears the record
+// state and then records the state of every record in the files as if they had just been published, so a
+// subsequent ingest of the same records publishes nothing. Neither touches the full dumps, held dumps, event
+// sequence or checkpoints; wiping removes everything.
+//
+func stateCommand(args []string) int {
+
+	if len(args) == 0 || (args[0] != "clear" && args[0] != "rebuild" && args[0] != "wipe") {
+		fmt.Fprintf(os.Stderr, "usage: %s state clear|rebuild|wipe [options] [file...]\n", filepath.Base(os.Args[0]))
+		return 2
+	}
+
+	flags := flag.NewFlagSet("state "+args[0], flag.ExitOnError)
+	storeName := flags.String("store", "", "the state store file")
+	source := flags.String("source", "", "the data source name (determines the id rules and filters)")
+	rules := flags.String("rules", "", "the data source configuration file")
+	marc8 := flags.Bool("marc8", false, "convert MARC-8 records to UTF-8")
+	codeTables := flags.String("codetables", "", "the MARC-8 code table file")
+	deletes := flags.String("deletes", defaultDeleteListPatterns, "the file name patterns that identify delete lists")
+	flags.Parse(args[1:])
+
+	if *storeName == "" || (args[0] == "rebuild" && flags.NArg() == 0) {
+		fmt.Fprintf(os.Stderr, "usage: %s state %s [options] [file...]\n", filepath.Base(os.Args[0]), args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+
+	store, err := openStateStore(*storeName)
+	if err != nil {
+		return 2
+	}
+	defer store.close()
+
+	if args[0] == "wipe" {
+		log.Printf("INFO: removing everything from state store %s", *storeName)
+		err = store.clear()
+		if err != nil {
+			log.Printf("ERROR: %s", err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	log.Printf("INFO: clearing the record state in state store %s", *storeName)
+	err = store.clearRecordStates()
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		return 1
+	}
+
+	if args[0] == "clear" {
+		return 0
+	}
+
+	sourceConfigs, err := loadSourceConfigs(*rules)
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		return 2
+	}
+
+	tmpDir, err := ioutil.TempDir("", "marc-state")
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		return 2
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := ServiceConfig{
+		DataSource:         *source,
+		DownloadDir:        tmpDir,
+		Marc8Transcode:     *marc8,
+		Marc8CodeTables:    *codeTables,
+		SourceConfigs:      sourceConfigs,
+		ErrorPolicy:        errorPolicyQuarantine,
+		MergeControlPolicy: mergeControlFirst,
+		OversizePolicy:     oversizeReject,
+		DuplicatePolicy:    duplicateIgnore,
+		DeleteListPatterns: strings.Split(*deletes, ","),
+	}
+
+	changes := newChangeDetector(store)
+	for _, name := range flags.Args() {
+
+		files, err := localInputFiles(cfg, name)
+		if err != nil {
+			log.Printf("ERROR: %s cannot be read (%s)", name, err.Error())
+			return 1
+		}
+
+		for _, file := range files {
+			err = rebuildFileState(fileConfig(cfg, file), file, changes)
+			if err != nil {
+				log.Printf("ERROR: %s cannot be loaded (%s)", file.RemoteName, err.Error())
+				return 1
+			}
+		}
+	}
+
+	count, err := store.recordCount()
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		return 1
+	}
+	log.Printf("INFO: state store %s rebuilt, %d records", *storeName, count)
+	return 0
+}
+
+// record the state of each record in the file, the same records are considered as when ingesting
+func rebuildFileState(fileCfg ServiceConfig, file NameTuple, changes *changeDetector) error {
+
+	loader, err := NewRecordLoader(fileCfg, file.RemoteName, file.LocalName)
+	if err != nil {
+		return err
+	}
+	defer loader.Done()
+
+	source := loader.Source()
+	if fileCfg.DataSource != "" {
+		source = fileCfg.DataSource
+	}
+	filter := newRecordFilter(fileCfg.SourceConfigs.forSource(source).Filters)
+
+	count := 0
+	rec, err := loader.First(true)
+	for err == nil {
+		if fileCfg.DataSource != "" {
+			rec.SetSource(fileCfg.DataSource)
+		}
+		if filter.publish(rec) == true {
+			// nothing is published, the state is recorded as if it had been
+			var change *recordChange
+			change, err = changes.changed(file.RemoteName, rec)
+			if err != nil {
+				return err
+			}
+			change.confirm()
+			count++
+		}
+		rec, err = loader.Next(true)
+	}
+
+	if err != io.EOF {
+		return err
+	}
+
+	log.Printf("INFO: %s: recorded the state of %d records", file.RemoteName, count)
+	return changes.flush()
+}
+
+//
+// end of file
+//
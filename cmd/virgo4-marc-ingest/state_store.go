@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// the buckets within the state store
+var stateBucketRecords = []byte("records")         // record id -> recordState
+var stateBucketFullDumps = []byte("full-dumps")    // data source -> fullDumpState
+var stateBucketHeldDumps = []byte("held-dumps")    // data source -> heldDump
+var stateBucketSequencers = []byte("sequencers")   // object (bucket/key) -> event sequencer
+var stateBucketCheckpoints = []byte("checkpoints") // file name -> checkpointState
+
+// the record ids of each full dump are kept in their own bucket, the name begins with this
+var fullDumpBucketPrefix = "full-dump/"
+
+// how long we wait for the state store lock, another process may have it open
+var stateStoreLockTimeout = 10 * time.Second
+
+// ErrStateStoreNotOpen - the state store is not open
+var ErrStateStoreNotOpen = fmt.Errorf("state store is not open")
+
+//
+// the state we keep on local disk between ingests. It is an embedded key/value store so there is nothing
+// else to deploy, the file should be on a persistent volume.
+//
+type stateStore struct {
+	Filename string   // the store file
+	db       *bolt.DB // the underlying store
+}
+
+// the state of a single record, as of the last time it was published
+type recordState struct {
+	Hash    string    `json:"hash"`    // the content hash
+	File    string    `json:"file"`    // the file the record was last seen in
+	Updated time.Time `json:"updated"` // when the record was last published
+}
+
+// the state of the last full dump accepted for a data source
+type fullDumpState struct {
+	Bucket   string    `json:"bucket"`   // the bucket containing the record ids
+	File     string    `json:"file"`     // the file the dump was loaded from
+	Records  int       `json:"records"`  // the number of record ids
+	Size     int64     `json:"size"`     // the size of the object the dump was loaded from
+	Accepted time.Time `json:"accepted"` // when the dump was accepted
+}
+
+// open the state store, it is created if it does not exist
+func openStateStore(filename string) (*stateStore, error) {
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: stateStoreLockTimeout})
+	if err != nil {
+		log.Printf("ERROR: unable to open state store %s (%s)", filename, err.Error())
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(stateBucketRecords)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(stateBucketFullDumps)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(stateBucketHeldDumps)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(stateBucketSequencers)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(stateBucketCheckpoints)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Printf("INFO: opened state store %s", filename)
+	return &stateStore{Filename: filename, db: db}, nil
+}
+
+func (s *stateStore) close() {
+
+	if s != nil && s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+}
+
+// get the state of the specified record, returns false if we know nothing about it
+func (s *stateStore) recordState(id string) (recordState, bool, error) {
+
+	var state recordState
+	found := false
+
+	if s.db == nil {
+		return state, found, ErrStateStoreNotOpen
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(stateBucketRecords).Get([]byte(id))
+		if buf == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(buf, &state)
+	})
+	return state, found, err
+}
+
+// update the state of a set of records in a single transaction, a nil state removes the record
+func (s *stateStore) updateRecordStates(states map[string]*recordState) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucketRecords)
+		for id, state := range states {
+			if state == nil {
+				err := bucket.Delete([]byte(id))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			buf, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(id), buf)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forget the state of every record
+func (s *stateStore) clearRecordStates() error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(stateBucketRecords)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err = tx.CreateBucket(stateBucketRecords)
+		return err
+	})
+}
+
+// remove everything from the store
+func (s *stateStore) clear() error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		names := make([][]byte, 0)
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, append([]byte(nil), name...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			err = tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.CreateBucket(stateBucketRecords)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(stateBucketFullDumps)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(stateBucketHeldDumps)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(stateBucketSequencers)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(stateBucketCheckpoints)
+		return err
+	})
+}
+
+// get the state of the last full dump for the data source, returns false if there has not been one
+func (s *stateStore) fullDumpState(source string) (fullDumpState, bool, error) {
+
+	var state fullDumpState
+	found := false
+
+	if s.db == nil {
+		return state, found, ErrStateStoreNotOpen
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(stateBucketFullDumps).Get([]byte(source))
+		if buf == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(buf, &state)
+	})
+	return state, found, err
+}
+
+// add record ids to the specified full dump bucket, it is created if necessary
+func (s *stateStore) addFullDumpIds(bucket string, ids []string) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			err = b.Put([]byte(id), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the record ids in the previous bucket that are not in the current one
+func (s *stateStore) vanishedIds(previous string, current string) ([]string, error) {
+
+	if s.db == nil {
+		return nil, ErrStateStoreNotOpen
+	}
+
+	vanished := make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prev := tx.Bucket([]byte(previous))
+		if prev == nil {
+			return nil
+		}
+		curr := tx.Bucket([]byte(current))
+
+		return prev.ForEach(func(id []byte, _ []byte) error {
+			if curr == nil || curr.Get(id) == nil {
+				vanished = append(vanished, string(id))
+			}
+			return nil
+		})
+	})
+	return vanished, err
+}
+
+// make the state the current full dump state for the data source, the previous dump ids are removed
+func (s *stateStore) acceptFullDump(source string, state fullDumpState, previous string) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// an empty dump has no bucket
+		_, err := tx.CreateBucketIfNotExists([]byte(state.Bucket))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(stateBucketFullDumps).Put([]byte(source), buf)
+		if err != nil {
+			return err
+		}
+
+		if previous != "" && previous != state.Bucket {
+			err = tx.DeleteBucket([]byte(previous))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// remove a full dump bucket, used when a dump is abandoned
+func (s *stateStore) removeFullDump(bucket string) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucket))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// hold a full dump for the data source, it replaces any dump already held which is returned
+func (s *stateStore) holdFullDump(held heldDump) (heldDump, bool, error) {
+
+	var replaced heldDump
+	found := false
+
+	if s.db == nil {
+		return replaced, found, ErrStateStoreNotOpen
+	}
+
+	buf, err := json.Marshal(held)
+	if err != nil {
+		return replaced, found, err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucketHeldDumps)
+		if prev := bucket.Get([]byte(held.Source)); prev != nil {
+			err := json.Unmarshal(prev, &replaced)
+			if err != nil {
+				return err
+			}
+			found = true
+		}
+
+		return bucket.Put([]byte(held.Source), buf)
+	})
+	return replaced, found, err
+}
+
+// the full dumps currently held
+func (s *stateStore) heldDumps() ([]heldDump, error) {
+
+	if s.db == nil {
+		return nil, ErrStateStoreNotOpen
+	}
+
+	held := make([]heldDump, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucketHeldDumps).ForEach(func(_ []byte, buf []byte) error {
+			var h heldDump
+			err := json.Unmarshal(buf, &h)
+			if err != nil {
+				return err
+			}
+			held = append(held, h)
+			return nil
+		})
+	})
+	return held, err
+}
+
+// forget about the full dump held for the data source
+func (s *stateStore) releaseHeldDump(source string) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucketHeldDumps).Delete([]byte(source))
+	})
+}
+
+// the sequencer of the last event processed for the object, blank if there has not been one
+func (s *stateStore) eventSequencer(object string) (string, error) {
+
+	if s.db == nil {
+		return "", ErrStateStoreNotOpen
+	}
+
+	sequencer := ""
+	err := s.db.View(func(tx *bolt.Tx) error {
+		sequencer = string(tx.Bucket(stateBucketSequencers).Get([]byte(object)))
+		return nil
+	})
+	return sequencer, err
+}
+
+func (s *stateStore) setEventSequencer(object string, sequencer string) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucketSequencers).Put([]byte(object), []byte(sequencer))
+	})
+}
+
+// get the checkpoint of the specified file, returns false if there is not one
+func (s *stateStore) checkpointState(file string) (checkpointState, bool, error) {
+
+	var state checkpointState
+	found := false
+
+	if s.db == nil {
+		return state, found, ErrStateStoreNotOpen
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(stateBucketCheckpoints).Get([]byte(file))
+		if buf == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(buf, &state)
+	})
+	return state, found, err
+}
+
+func (s *stateStore) setCheckpointState(state checkpointState) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucketCheckpoints).Put([]byte(state.File), buf)
+	})
+}
+
+func (s *stateStore) removeCheckpointState(file string) error {
+
+	if s.db == nil {
+		return ErrStateStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucketCheckpoints).Delete([]byte(file))
+	})
+}
+
+// the number of records we know about
+func (s *stateStore) recordCount() (int, error) {
+
+	if s.db == nil {
+		return 0, ErrStateStoreNotOpen
+	}
+
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(stateBucketRecords).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+//
+// end of file
+//
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+// ErrNotStreamable - the inbound object cannot be ingested as a stream
+var ErrNotStreamable = fmt.Errorf("zip archives cannot be streamed")
+
+// opens S3 objects as streams so they can be ingested without downloading them first. Also used to download
+// specific object versions
+type s3Streamer struct {
+	svc        *s3.S3
+	downloader *s3manager.Downloader
+}
+
+func newS3Streamer() (*s3Streamer, error) {
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(sess)
+	return &s3Streamer{svc: svc, downloader: s3manager.NewDownloaderWithClient(svc)}, nil
+}
+
+// the request for the object, a specific version if the event was about one
+func getObjectInput(f InboundFile) *s3.GetObjectInput {
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(f.SourceBucket),
+		Key:    aws.String(f.SourceKey),
+	}
+	if f.VersionId != "" {
+		input.VersionId = aws.String(f.VersionId)
+	}
+	return input
+}
+
+// open the object body as a stream
+func (s *s3Streamer) open(f InboundFile) (io.ReadCloser, error) {
+
+	out, err := s.svc.GetObject(getObjectInput(f))
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// download a specific version of the object to a local file
+func (s *s3Streamer) download(f InboundFile, localName string) error {
+
+	file, err := os.Create(localName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	log.Printf("INFO: get s3://%s/%s (version %s) to %s", f.SourceBucket, f.SourceKey, f.VersionId, localName)
+	size, err := s.downloader.Download(file, getObjectInput(f))
+	if err != nil {
+		return err
+	}
+
+	if f.ObjectSize != 0 && size != f.ObjectSize {
+		os.Remove(localName)
+		return fmt.Errorf("download failure. expected %d bytes, received %d bytes", f.ObjectSize, size)
+	}
+	return nil
+}
+
+//
+// ingest an inbound object by reading it directly from S3. Records are validated as they are read and
+// published as they are validated so everything happens in a single pass. Because of this, a file that
+// turns out to be invalid part way through (or has more bad records than the threshold) will have been
+// partially ingested; the reject report says how far we got. Files cannot be rejected before they are
+// ingested so only the quarantine error policy is supported.
+//
+func streamInboundFile(cfg ServiceConfig, streamer *s3Streamer, s3Svc uva_s3.UvaS3, f InboundFile, batch *ingestBatch, records chan<- Record) error {
+
+	file := NameTuple{
+		RemoteName: fmt.Sprintf("%s/%s", f.SourceBucket, f.SourceKey),
+		ObjectSize: f.ObjectSize,
+		ETag:       f.ETag,
+	}
+
+	// the stream is opened again if we need to rewind it
+	input, err := newInputStream(file.RemoteName, func() (io.ReadCloser, error) {
+		return streamer.open(f)
+	})
+	if err != nil {
+		return err
+	}
+	defer input.close()
+
+	// a file we cannot expand or read is rejected, anything else means the notification is redelivered
+	err = streamInput(cfg, s3Svc, file, input, batch, records, 0)
+	if err != nil && isDataError(err) == true {
+		log.Printf("ERROR: %s appears to be invalid (%s)", file.RemoteName, err.Error())
+		return writeRejectReport(cfg, s3Svc, RejectReport{File: file.RemoteName, Rejected: true, Reason: err.Error()})
+	}
+	return err
+}
+
+// is the error a problem with the content of the file, rather than a failure reading it or keeping our state
+func isDataError(err error) bool {
+
+	if isReadFailure(err) == true {
+		return false
+	}
+
+	var recErr *recordError
+	var numErr *strconv.NumError
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &recErr) == true || errors.As(err, &numErr) == true || errors.As(err, &syntaxErr) == true {
+		return true
+	}
+
+	for _, dataErr := range []error{ErrBadRecord, ErrRecordTooLarge, ErrNotMarcRecord, ErrNoIdRuleMatched, ErrDuplicateRecord, ErrUnknownMnemonic,
+		ErrTooManyBadRecords, ErrCorruptCompressedFile, ErrUnsupportedCompression, io.ErrUnexpectedEOF} {
+		if errors.Is(err, dataErr) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// the content of a compressed stream or archive member, anything that goes wrong that is not a failure reading
+// the underlying stream is a problem with the compressed data
+type expandedReader struct {
+	reader io.Reader
+}
+
+func (r expandedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = expansionError(err)
+	}
+	return n, err
+}
+
+func expansionError(err error) error {
+	if isReadFailure(err) == true {
+		return err
+	}
+	return corruptionError(err)
+}
+
+// ingest the input, decompressing it and expanding archives as necessary
+func streamInput(cfg ServiceConfig, s3Svc uva_s3.UvaS3, file NameTuple, input *inputStream, batch *ingestBatch, records chan<- Record, depth int) error {
+
+	buf, err := input.peek(compressionSniffSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	compression := identifyCompression(buf, file.RemoteName)
+	if compression == compressionNone {
+		return streamRecords(cfg, s3Svc, file, input, batch, records)
+	}
+
+	if depth >= maxExpandDepth {
+		log.Printf("ERROR: %s is nested too deeply", file.RemoteName)
+		return ErrUnsupportedCompression
+	}
+
+	log.Printf("INFO: %s identified as %s, expanding", file.RemoteName, compression)
+
+	switch compression {
+	case archiveZip:
+		// zip archives keep their directory at the end so they need random access
+		log.Printf("ERROR: %s is a zip archive and cannot be streamed", file.RemoteName)
+		return writeRejectReport(cfg, s3Svc, RejectReport{File: file.RemoteName, Rejected: true, Reason: ErrNotStreamable.Error()})
+
+	case archiveTar:
+		archive := tar.NewReader(input)
+		for {
+			hdr, err := archive.Next()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return expansionError(err)
+			}
+
+			if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+				continue
+			}
+
+			member := newArchiveMember(cfg, file, hdr.Name, hdr.Size)
+			err = streamInput(cfg, s3Svc, member, newOneShotInputStream(member.RemoteName, ioutil.NopCloser(expandedReader{reader: archive})), batch, records, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		reader, err := decompressStream(input, compression)
+		if err != nil {
+			return expansionError(err)
+		}
+		defer reader.Close()
+
+		decompressed := NameTuple{RemoteName: stripCompressionSuffix(file.RemoteName), DataSource: file.DataSource, ObjectSize: file.ObjectSize, ETag: file.ETag}
+		body := ioutil.NopCloser(expandedReader{reader: reader})
+		return streamInput(cfg, s3Svc, decompressed, newOneShotInputStream(decompressed.RemoteName, body), batch, records, depth+1)
+	}
+}
+
+// read the records from the input and publish them
+func streamRecords(cfg ServiceConfig, s3Svc uva_s3.UvaS3, file NameTuple, input *inputStream, batch *ingestBatch, records chan<- Record) error {
+
+	start := time.Now()
+	fileCfg := fileConfig(cfg, file)
+
+	// a full dump that looks suspicious is held, nothing in it is published until an operator approves it. We
+	// cannot count the records without reading them so only the size is checked
+	if matchesFileName(cfg.FullDumpPatterns, file.RemoteName) == true {
+		source := fileCfg.DataSource
+		if source == "" {
+			source = getDataSource(source, file.RemoteName)
+		}
+		held, err := checkFullDumpFile(cfg, batch.store, source, file, 0)
+		if err != nil {
+			return err
+		}
+		if held != nil {
+			return holdFullDump(cfg, batch.store, *held, input)
+		}
+	}
+
+	log.Printf("INFO: streaming %s", file.RemoteName)
+	loader, err := newStreamRecordLoader(fileCfg, file.RemoteName, input)
+	if err != nil {
+		return err
+	}
+
+	count, err := ingestRecords(fileCfg, file, loader, batch, records)
+	badRecords := loader.BadRecords()
+	loader.Done()
+
+	// only a problem with the content rejects the file, if we failed for any other reason it is ingested again
+	if err != nil && isDataError(err) == false {
+		return err
+	}
+
+	// when quarantining, too many bad records means we reject the file anyway
+	if err == nil && cfg.ErrorPolicy == errorPolicyQuarantine && len(badRecords) > cfg.BadRecordThreshold {
+		log.Printf("ERROR: %s has %d bad records, threshold is %d", file.RemoteName, len(badRecords), cfg.BadRecordThreshold)
+		err = ErrTooManyBadRecords
+	}
+
+	if err != nil {
+		log.Printf("ERROR: %s appears to be invalid after %d records (%s)", file.RemoteName, count, err.Error())
+		reason := fmt.Sprintf("%s (after %d records were ingested)", err.Error(), count)
+		return writeRejectReport(cfg, s3Svc, RejectReport{File: file.RemoteName, Rejected: true, Reason: reason, BadRecords: badRecords})
+	}
+
+	duration := time.Since(start)
+	log.Printf("INFO: done streaming %s. %d records, %d skipped, %d duplicates, %d unchanged (%0.2f tps)", file.RemoteName, count, len(badRecords),
+		batch.duplicates.duplicates(file.RemoteName), batch.changes.unchangedCount(file.RemoteName), float64(count)/duration.Seconds())
+
+	if len(badRecords) != 0 {
+		return writeRejectReport(cfg, s3Svc, RejectReport{File: file.RemoteName, BadRecords: badRecords})
+	}
+	return nil
+}
+
+//
+// end of file
+//
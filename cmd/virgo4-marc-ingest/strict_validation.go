@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// finding severities
+var severityError = "error"     // the record is structurally invalid
+var severityWarning = "warning" // the record is usable but not valid MARC21
+
+// ErrStrictValidationFailed - the file failed strict validation
+var ErrStrictValidationFailed = fmt.Errorf("strict validation failed")
+
+// ValidationFinding - a single problem found with a record
+type ValidationFinding struct {
+	Offset   int64  `json:"offset"`              // the byte offset of the record within the file
+	RecordId string `json:"record_id,omitempty"` // the record id, if it could be determined
+	Severity string `json:"severity"`            // error or warning
+	Check    string `json:"check"`               // the check that failed
+	Message  string `json:"message"`             // the details
+}
+
+// ValidationReport - the result of strict validation of a file
+type ValidationReport struct {
+	File      string              `json:"file"`      // the remote file name (bucket/key)
+	Records   int                 `json:"records"`   // the number of records examined
+	Errors    int                 `json:"errors"`    // the number of error findings
+	Warnings  int                 `json:"warnings"`  // the number of warning findings
+	Findings  []ValidationFinding `json:"findings"`  // the findings
+	Timestamp time.Time           `json:"timestamp"` // when the report was generated
+}
+
+// the legal leader codes for each leader position we check. Blank means any value is acceptable
+var leaderCodes = map[int]string{
+	5:  "acdnp",
+	6:  "acdefgijkmoprtuvxyzq",
+	8:  " a",
+	9:  " a",
+	17: " 12345678uzIJKLM",
+	18: " acinu",
+	19: " abc",
+}
+
+// the bibliographic level only applies to bibliographic records
+var bibliographicTypes = "acdefgijkmoprt"
+var bibliographicLevels = "abcdims"
+
+// strictly validate every record in the file, nothing is ingested
+func strictValidateFile(config ServiceConfig, remoteName string, localName string) (*ValidationReport, error) {
+
+	// we want to see every record so we do not stop at the first bad one. We check the records as they are in
+	// the file, transcoding would rebuild them and hide any problems with the length and directory
+	config.ErrorPolicy = errorPolicyQuarantine
+	config.Marc8Transcode = false
+	loader, err := NewRecordLoader(config, remoteName, localName)
+	if err != nil {
+		return nil, err
+	}
+	defer loader.Done()
+
+	report := &ValidationReport{File: remoteName, Findings: make([]ValidationFinding, 0), Timestamp: time.Now()}
+
+	rec, err := loader.First(false)
+	for err == nil {
+		report.Records++
+		report.add(checkRecord(rec)...)
+		rec, err = loader.Next(false)
+	}
+
+	if err != io.EOF {
+		report.add(ValidationFinding{Severity: severityError, Check: "framing", Message: fmt.Sprintf("cannot continue: %s", err.Error())})
+	}
+
+	// the records that could not be framed at all
+	for _, bad := range loader.BadRecords() {
+		report.add(ValidationFinding{Offset: bad.Offset, Severity: severityError, Check: "framing", Message: bad.Reason})
+	}
+
+	// report the findings in file order
+	sort.SliceStable(report.Findings, func(i, j int) bool { return report.Findings[i].Offset < report.Findings[j].Offset })
+
+	log.Printf("INFO: strict validation of %s: %d records, %d errors, %d warnings", remoteName, report.Records, report.Errors, report.Warnings)
+	return report, nil
+}
+
+func (v *ValidationReport) add(findings ...ValidationFinding) {
+
+	for _, f := range findings {
+		if f.Severity == severityError {
+			v.Errors++
+		} else {
+			v.Warnings++
+		}
+		v.Findings = append(v.Findings, f)
+	}
+}
+
+// check a single record
+func checkRecord(rec Record) []ValidationFinding {
+
+	// delete list entries have no structure to check
+	if rec.Format() == recordFormatDeleteList {
+		return nil
+	}
+
+	// the raw record is as it was read from the file
+	offset := rec.(*recordImpl).offset
+	findings := checkMarcStructure(rec.Raw())
+
+	id, err := rec.Id()
+	if err != nil {
+		findings = append(findings, ValidationFinding{Severity: severityError, Check: "id", Message: err.Error()})
+	}
+
+	for ix := range findings {
+		findings[ix].Offset = offset
+		findings[ix].RecordId = id
+	}
+	return findings
+}
+
+//
+// check the structure of a raw ISO 2709 record. We do not use the parsed form because the parser is deliberately
+// tolerant of the problems we are looking for
+//
+func checkMarcStructure(raw []byte) []ValidationFinding {
+
+	findings := make([]ValidationFinding, 0)
+	fail := func(severity string, check string, format string, args ...interface{}) {
+		findings = append(findings, ValidationFinding{Severity: severity, Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(raw) < marcRecordLeaderSize+1 {
+		fail(severityError, "leader", "record too short (%d bytes)", len(raw))
+		return findings
+	}
+
+	leader := raw[0:marcRecordLeaderSize]
+
+	// the record length
+	length, err := strconv.Atoi(string(leader[0:5]))
+	if err != nil || isAsciiDigits(leader[0:5]) == false {
+		fail(severityError, "record-length", "record length is not numeric (%s)", string(leader[0:5]))
+	} else if length != len(raw) {
+		fail(severityError, "record-length", "leader record length %d does not match the record size %d", length, len(raw))
+	}
+
+	if raw[len(raw)-1] != recordTerminator {
+		fail(severityError, "record-terminator", "record does not end with a record terminator")
+	}
+
+	// the leader codes
+	findings = append(findings, checkLeaderCodes(leader)...)
+
+	// the directory ends at the first field terminator
+	dirEnd := bytes.IndexByte(raw[marcRecordFieldDirStart:], fieldTerminator)
+	if dirEnd == -1 {
+		fail(severityError, "directory", "cannot locate the end of the directory")
+		return findings
+	}
+	dirEnd += marcRecordFieldDirStart
+
+	if (dirEnd-marcRecordFieldDirStart)%marcRecordFieldDirEntrySize != 0 {
+		fail(severityError, "directory", "directory length %d is not a multiple of %d", dirEnd-marcRecordFieldDirStart, marcRecordFieldDirEntrySize)
+	}
+
+	baseAddress, err := strconv.Atoi(string(leader[12:17]))
+	if err != nil || isAsciiDigits(leader[12:17]) == false {
+		fail(severityError, "base-address", "base address is not numeric (%s)", string(leader[12:17]))
+		return findings
+	}
+	if baseAddress != dirEnd+1 {
+		fail(severityError, "base-address", "base address %d does not match the end of the directory %d", baseAddress, dirEnd+1)
+		baseAddress = dirEnd + 1
+	}
+
+	// each of the directory entries
+	for pos := marcRecordFieldDirStart; pos+marcRecordFieldDirEntrySize <= dirEnd; pos += marcRecordFieldDirEntrySize {
+		entry := raw[pos : pos+marcRecordFieldDirEntrySize]
+		tag := string(entry[0:3])
+
+		// strconv accepts a sign, a negative length or offset is out of bounds
+		fieldLength, err1 := strconv.Atoi(string(entry[3:7]))
+		fieldOffset, err2 := strconv.Atoi(string(entry[7:12]))
+		if err1 != nil || err2 != nil {
+			fail(severityError, "directory", "field %s directory entry is not numeric (%s)", tag, string(entry))
+			continue
+		}
+		if isAsciiDigits(entry[3:7]) == false || isAsciiDigits(entry[7:12]) == false {
+			fail(severityError, "field-bounds", "field %s directory entry is not all digits (%s)", tag, string(entry))
+			continue
+		}
+
+		start := baseAddress + fieldOffset
+		end := start + fieldLength
+		if fieldLength <= 0 || start < baseAddress || end > len(raw)-1 {
+			fail(severityError, "field-bounds", "field %s (offset %d, length %d) is out of bounds", tag, fieldOffset, fieldLength)
+			continue
+		}
+
+		data := raw[start:end]
+		if data[len(data)-1] != fieldTerminator {
+			fail(severityError, "field-terminator", "field %s does not end with a field terminator", tag)
+			continue
+		}
+		data = data[:len(data)-1]
+
+		if isControlData(tag, data) == true {
+			continue
+		}
+
+		// data fields need 2 indicators followed by a subfield
+		if len(data) < 2 || data[0] == subfieldDelimiter || data[1] == subfieldDelimiter {
+			fail(severityError, "indicators", "field %s is missing indicators", tag)
+			continue
+		}
+		for _, ind := range data[0:2] {
+			if ind != ' ' && (ind < '0' || ind > '9') && (ind < 'a' || ind > 'z') {
+				fail(severityWarning, "indicators", "field %s has an invalid indicator (%q)", tag, ind)
+			}
+		}
+		if len(data) == 2 || data[2] != subfieldDelimiter {
+			fail(severityError, "subfields", "field %s has no subfields", tag)
+		}
+	}
+
+	return findings
+}
+
+// check the leader contains legal codes
+func checkLeaderCodes(leader []byte) []ValidationFinding {
+
+	findings := make([]ValidationFinding, 0)
+	for _, pos := range []int{5, 6, 8, 9, 17, 18, 19} {
+		if strings.IndexByte(leaderCodes[pos], leader[pos]) == -1 {
+			findings = append(findings, ValidationFinding{Severity: severityWarning, Check: "leader-codes",
+				Message: fmt.Sprintf("leader position %02d has an invalid code (%q)", pos, leader[pos])})
+		}
+	}
+
+	if strings.IndexByte(bibliographicTypes, leader[6]) != -1 && strings.IndexByte(bibliographicLevels, leader[7]) == -1 {
+		findings = append(findings, ValidationFinding{Severity: severityWarning, Check: "leader-codes",
+			Message: fmt.Sprintf("leader position 07 has an invalid bibliographic level (%q)", leader[7])})
+	}
+
+	if string(leader[10:12]) != "22" {
+		findings = append(findings, ValidationFinding{Severity: severityError, Check: "leader-codes",
+			Message: fmt.Sprintf("indicator count and subfield code length must be 22 (%s)", string(leader[10:12]))})
+	}
+
+	if string(leader[20:24]) != "4500" {
+		findings = append(findings, ValidationFinding{Severity: severityError, Check: "leader-codes",
+			Message: fmt.Sprintf("entry map must be 4500 (%s)", string(leader[20:24]))})
+	}
+
+	return findings
+}
+
+//
+// end of file
+//
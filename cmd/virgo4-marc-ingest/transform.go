@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Transformer - makes changes to a record before it is published
+type Transformer interface {
+	Name() string                        // used for reporting
+	Transform(*marcRecord, string) error // transform the parsed record, the data source is provided
+}
+
+// implemented by transforms that change the record id, so they can also be applied to the ids in delete lists
+type idTransformer interface {
+	TransformId(string) string // transform an id as if it were the 001 field
+	TransformsIds() bool       // is the record id taken from the field the transform changes
+}
+
+// TransformConfig - the configuration of a single built in transform. Which of the settings are used depends
+// on the type of transform
+type TransformConfig struct {
+	Type   string   `json:"type"`   // the transform type
+	Tags   []string `json:"tags"`   // the tags to remove, X is a wildcard (strip_fields)
+	Tag    string   `json:"tag"`    // the tag to add (add_ingest_field)
+	Strip  string   `json:"strip"`  // a regular expression, anything it matches is removed (normalize_001)
+	Prefix string   `json:"prefix"` // the prefix the id should have (normalize_001)
+}
+
+// the built in transform types
+var transformStripFields = "strip_fields"        // remove fields by tag
+var transformAddIngestField = "add_ingest_field" // add a field containing the data source and ingest time
+var transformNormalize001 = "normalize_001"      // normalize the 001 field
+
+// the tag used by add_ingest_field unless configured otherwise
+var defaultIngestFieldTag = "999"
+
+// create the transformer described by the configuration, idTag is the field the data source takes its record ids from
+func newTransformer(config TransformConfig, idTag string) (Transformer, error) {
+
+	switch config.Type {
+	case transformStripFields:
+		if len(config.Tags) == 0 {
+			return nil, fmt.Errorf("%s requires one or more tags", config.Type)
+		}
+		for _, tag := range config.Tags {
+			if len(tag) != 3 {
+				return nil, fmt.Errorf("%s tag is invalid (%s)", config.Type, tag)
+			}
+		}
+		return &stripFieldsTransformer{tags: config.Tags}, nil
+
+	case transformAddIngestField:
+		tag := config.Tag
+		if tag == "" {
+			tag = defaultIngestFieldTag
+		}
+		if len(tag) != 3 || isControlTag(tag) == true {
+			return nil, fmt.Errorf("%s tag must be a data field (%s)", config.Type, tag)
+		}
+		return &addIngestFieldTransformer{tag: tag}, nil
+
+	case transformNormalize001:
+		t := &normalize001Transformer{prefix: config.Prefix, ids: idTag == "001"}
+		if config.Strip != "" {
+			expr, err := regexp.Compile(config.Strip)
+			if err != nil {
+				return nil, err
+			}
+			t.stripExpr = expr
+		}
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("unsupported transform type (%s)", config.Type)
+}
+
+//
+// apply the transforms to the record. The record is serialized again afterwards so the result is always a valid
+// MARC record; if that is not possible (the record has grown too large) an error is returned and the original
+// record is unchanged. Deleted records are transformed too, they are sent without their content but the
+// transforms may change the id they were published with.
+//
+func applyTransforms(transformers []Transformer, rec Record) (Record, error) {
+
+	if len(transformers) == 0 {
+		return rec, nil
+	}
+
+	// delete list entries are just an id
+	if rec.Format() == recordFormatDeleteList {
+		return transformDeleteId(transformers, rec)
+	}
+
+	impl := rec.(*recordImpl)
+	parsed, err := impl.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// work on a copy, the fields are values so copying the slice is enough
+	transformed := &marcRecord{leader: parsed.leader, fields: append([]MarcField(nil), parsed.fields...)}
+	for _, t := range transformers {
+		err = t.Transform(transformed, rec.Source())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Name(), err)
+		}
+	}
+
+	result, err := newRecordFromParsed(transformed, impl.source, impl.format)
+	if err != nil {
+		return nil, err
+	}
+
+	resultImpl := result.(*recordImpl)
+	resultImpl.offset = impl.offset
+	resultImpl.idRules = impl.idRules
+	resultImpl.honorDeletes = impl.honorDeletes
+
+	// the transforms may have changed the id
+	_, err = result.Id()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// apply the transforms that change the record id to a delete list entry, the id is treated as the 001 field. Data
+// sources whose ids are taken from another field have their delete list ids left alone
+func transformDeleteId(transformers []Transformer, rec Record) (Record, error) {
+
+	id, err := rec.Id()
+	if err != nil {
+		return nil, err
+	}
+
+	transformed := id
+	for _, t := range transformers {
+		if it, ok := t.(idTransformer); ok == true && it.TransformsIds() == true {
+			transformed = it.TransformId(transformed)
+		}
+	}
+	if transformed == id {
+		return rec, nil
+	}
+
+	result := newDeleteRecord(transformed, rec.Source())
+	result.(*recordImpl).offset = rec.(*recordImpl).offset
+	result.(*recordImpl).segments = rec.(*recordImpl).segments
+	return result, nil
+}
+
+// removes fields by tag
+type stripFieldsTransformer struct {
+	tags []string // the tags to remove, X is a wildcard
+}
+
+func (t *stripFieldsTransformer) Name() string {
+	return transformStripFields
+}
+
+func (t *stripFieldsTransformer) Transform(parsed *marcRecord, source string) error {
+
+	kept := parsed.fields[:0]
+	for _, f := range parsed.fields {
+		if t.matches(f.Tag) == false {
+			kept = append(kept, f)
+		}
+	}
+	parsed.fields = kept
+	return nil
+}
+
+func (t *stripFieldsTransformer) matches(tag string) bool {
+
+	for _, pattern := range t.tags {
+		matched := true
+		for ix := 0; ix < 3 && ix < len(tag); ix++ {
+			if pattern[ix] != 'X' && pattern[ix] != 'x' && pattern[ix] != tag[ix] {
+				matched = false
+				break
+			}
+		}
+		if matched == true {
+			return true
+		}
+	}
+	return false
+}
+
+// adds a field with the data source ($a) and the ingest timestamp ($b)
+type addIngestFieldTransformer struct {
+	tag string // the tag of the field we add
+}
+
+func (t *addIngestFieldTransformer) Name() string {
+	return transformAddIngestField
+}
+
+func (t *addIngestFieldTransformer) Transform(parsed *marcRecord, source string) error {
+
+	field := MarcField{
+		Tag:        t.tag,
+		Indicator1: " ",
+		Indicator2: " ",
+		Subfields: []MarcSubfield{
+			{Code: "a", Value: source},
+			{Code: "b", Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+	}
+
+	// keep the fields in tag order
+	ix := len(parsed.fields)
+	for ix > 0 && parsed.fields[ix-1].Tag > t.tag {
+		ix--
+	}
+	parsed.fields = append(parsed.fields, MarcField{})
+	copy(parsed.fields[ix+1:], parsed.fields[ix:])
+	parsed.fields[ix] = field
+	return nil
+}
+
+// normalizes the 001 field; removes anything matching the strip expression and ensures it has the prefix
+type normalize001Transformer struct {
+	stripExpr *regexp.Regexp // what to remove (optional)
+	prefix    string         // the required prefix (optional)
+	ids       bool           // the record ids are taken from the 001 field
+}
+
+func (t *normalize001Transformer) Name() string {
+	return transformNormalize001
+}
+
+func (t *normalize001Transformer) Transform(parsed *marcRecord, source string) error {
+
+	for ix := range parsed.fields {
+		if parsed.fields[ix].Tag != "001" {
+			continue
+		}
+
+		parsed.fields[ix].Value = t.TransformId(parsed.fields[ix].Value)
+	}
+	return nil
+}
+
+func (t *normalize001Transformer) TransformsIds() bool {
+	return t.ids
+}
+
+func (t *normalize001Transformer) TransformId(id string) string {
+
+	value := strings.TrimSpace(id)
+	if t.stripExpr != nil {
+		value = t.stripExpr.ReplaceAllString(value, "")
+	}
+	if t.prefix != "" && strings.HasPrefix(value, t.prefix) == false {
+		value = t.prefix + value
+	}
+
+	if value == "" {
+		log.Printf("WARNING: normalized 001 field is empty, leaving it unchanged")
+		return id
+	}
+	return value
+}
+
+//
+// end of file
+//
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// strictly validate one or more local files and write a JSON report to stdout, nothing is ingested. For example:
+//
+//    virgo4-marc-ingest validate -source hathi -rules sources.json file1.mrc file2.xml.gz
+//
+// the exit status is non-zero if any file has validation errors
+//
+func validateCommand(args []string) int {
+
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	source := flags.String("source", "", "the data source name (determines the id rules)")
+	rules := flags.String("rules", "", "the data source configuration file")
+	marc8 := flags.Bool("marc8", false, "convert MARC-8 records to UTF-8")
+	codeTables := flags.String("codetables", "", "the MARC-8 code table file")
+	deletes := flags.String("deletes", defaultDeleteListPatterns, "the file name patterns that identify delete lists")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s validate [options] file...\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+		return 2
+	}
+
+	// the logging goes to stderr so we do not pollute the report
+	log.SetOutput(os.Stderr)
+
+	sourceConfigs, err := loadSourceConfigs(*rules)
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		return 2
+	}
+
+	tmpDir, err := ioutil.TempDir("", "marc-validate")
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		return 2
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := ServiceConfig{
+		DataSource:      *source,
+		DownloadDir:     tmpDir,
+		Marc8Transcode:  *marc8,
+		Marc8CodeTables: *codeTables,
+		SourceConfigs:   sourceConfigs,
+
+		DeleteListPatterns: strings.Split(*deletes, ","),
+	}
+
+	status := 0
+	reports := make([]*ValidationReport, 0)
+	for _, name := range flags.Args() {
+
+		files, err := localInputFiles(cfg, name)
+		if err != nil {
+			log.Printf("ERROR: %s cannot be read (%s)", name, err.Error())
+			status = 1
+			continue
+		}
+
+		for _, file := range files {
+			report, err := strictValidateFile(fileConfig(cfg, file), file.RemoteName, file.LocalName)
+			if err != nil {
+				log.Printf("ERROR: %s cannot be validated (%s)", file.RemoteName, err.Error())
+				status = 1
+				continue
+			}
+			if report.Errors != 0 {
+				status = 1
+			}
+			reports = append(reports, report)
+		}
+	}
+
+	buf, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		return 2
+	}
+	fmt.Println(string(buf))
+	return status
+}
+
+// get the files to validate from a local file, decompressing and expanding it as necessary. We work on
+// a copy because expanding removes the original
+func localInputFiles(cfg ServiceConfig, name string) ([]NameTuple, error) {
+
+	in, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	localName, err := copyToTempFile(cfg.DownloadDir, in)
+	if err != nil {
+		return nil, err
+	}
+
+	return expandInboundFile(cfg, NameTuple{LocalName: localName, RemoteName: name})
+}
+
+//
+// end of file
+//
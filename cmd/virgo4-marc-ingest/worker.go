@@ -41,6 +41,7 @@ func worker(id int, config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.Qu
 				// send the block
 				err := sendOutboundMessages(config, aws, outQueue, cacheQueue, block)
 				fatalIfError(err)
+				confirmDelivery(block)
 
 				// reset the block
 				block = block[:0]
@@ -58,6 +59,7 @@ func worker(id int, config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.Qu
 				// send the block
 				err := sendOutboundMessages(config, aws, outQueue, cacheQueue, block)
 				fatalIfError(err)
+				confirmDelivery(block)
 
 				// reset the block
 				block = block[:0]
@@ -73,6 +75,13 @@ func worker(id int, config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.Qu
 	// should never get here
 }
 
+// the records have been put on the outbound queues
+func confirmDelivery(records []Record) {
+	for _, r := range records {
+		r.Delivery().delivered()
+	}
+}
+
 func sendOutboundMessages(config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.QueueHandle, cacheQueue awssqs.QueueHandle, records []Record) error {
 
 	count := len(records)
@@ -88,7 +97,10 @@ func sendOutboundMessages(config ServiceConfig, aws awssqs.AWS_SQS, outQueue aws
 	batch1 := make([]awssqs.Message, 0, count)
 	batch2 := make([]awssqs.Message, 0, count)
 	for _, m := range records {
-		msg := constructMessage(m)
+		msg, err := constructMessage(config, m)
+		if err != nil {
+			return err
+		}
 		batch1 = append(batch1, msg)
 		batch2 = append(batch2, msg)
 	}
@@ -132,15 +144,48 @@ func sendOutboundMessages(config ServiceConfig, aws awssqs.AWS_SQS, outQueue aws
 	return nil
 }
 
-func constructMessage(record Record) awssqs.Message {
+func constructMessage(config ServiceConfig, record Record) (awssqs.Message, error) {
 
 	id, _ := record.Id()
+
+	// deleted records only need to be identified
+	if record.Deleted() == true {
+		return constructDeleteMessage(id, record.Source()), nil
+	}
+
+	// records loaded from MARCXML can optionally be sent as xml
+	recordType := awssqs.AttributeValueRecordTypeB64Marc
+	var payload []byte
+	if config.XmlOutput == true && record.Format() == recordFormatXml {
+		xmlBytes, err := record.Xml()
+		if err != nil {
+			log.Printf("ERROR: unable to serialize record %s as xml (%s)", id, err.Error())
+			return awssqs.Message{}, err
+		}
+		recordType = awssqs.AttributeValueRecordTypeXml
+		payload = xmlBytes
+	} else {
+		payload = []byte(base64.StdEncoding.EncodeToString(record.Raw()))
+	}
+
 	attributes := make([]awssqs.Attribute, 0, 4)
 	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: id})
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordType, Value: awssqs.AttributeValueRecordTypeB64Marc})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordType, Value: recordType})
 	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordSource, Value: record.Source()})
 	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordOperation, Value: awssqs.AttributeValueRecordOperationUpdate})
-	return awssqs.Message{Attribs: attributes, Payload: []byte(base64.StdEncoding.EncodeToString(record.Raw()))}
+	return awssqs.Message{Attribs: attributes, Payload: payload}, nil
+}
+
+// a delete message, the payload is just the id because messages cannot be empty. It carries the same attributes
+// as an update so the payload is encoded in the same way
+func constructDeleteMessage(id string, source string) awssqs.Message {
+
+	attributes := make([]awssqs.Attribute, 0, 4)
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: id})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordType, Value: awssqs.AttributeValueRecordTypeB64Marc})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordSource, Value: source})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordOperation, Value: awssqs.AttributeValueRecordOperationDelete})
+	return awssqs.Message{Attribs: attributes, Payload: []byte(base64.StdEncoding.EncodeToString([]byte(id)))}
 }
 
 //
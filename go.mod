@@ -3,7 +3,9 @@ module github.com/uvalib/virgo4-marc-ingest
 go 1.14
 
 require (
-	github.com/aws/aws-sdk-go v1.55.8 // indirect
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/klauspost/compress v1.11.13
 	github.com/uvalib/uva-aws-s3-sdk/uva-s3 v0.0.0-20240202155653-277e11cf83e3
 	github.com/uvalib/virgo4-sqs-sdk/awssqs v0.0.0-20240403123433-2102b063dbb8
+	go.etcd.io/bbolt v1.3.5
 )